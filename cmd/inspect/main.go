@@ -0,0 +1,100 @@
+// Command inspect prints the context that a suspended flow will resume with.
+//
+//	inspect -dsn "user:pwd@tcp(127.0.0.1:3306)/db?parseTime=true" -id <recover_id|root_uid> [-format table|json] [-secret key -key-id id -encrypt k1,k2] [-blobs dir]
+//	inspect -dsn "user:pwd@tcp(127.0.0.1:3306)/db?parseTime=true" -verify [-sign key]
+//
+// With -verify it scans all checkpoints instead, prints the ones that do not match their digest and exits with 1 if any.
+//
+// Values of types registered by flow.RegisterType can only be decoded by a binary that registers them,
+// call SuspendPlugin.Inspect in your own program to inspect them.
+package main
+
+import (
+	"flag"
+	"fmt"
+	plugins "github.com/Bilibotter/light-flow-plugins/orm"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"os"
+	"strings"
+)
+
+func main() {
+	dsn := flag.String("dsn", "", "mysql dsn of the database storing checkpoints")
+	id := flag.String("id", "", "recover id, or root uid to inspect its latest recover record")
+	format := flag.String("format", "table", "output format, table or json")
+	tenant := flag.String("tenant", "", "tenant of the checkpoints if tenant isolation is enabled")
+	secret := flag.String("secret", "", "secret of the AES256 encryptor")
+	encrypt := flag.String("encrypt", "", "comma separated keys encrypted by the encryptor")
+	keyId := flag.String("key-id", "", "key id of the secret in the keyring")
+	blobs := flag.String("blobs", "", "directory of the file blob store if snapshots are offloaded")
+	verify := flag.Bool("verify", false, "verify the digests of all checkpoints instead of inspecting")
+	sign := flag.String("sign", "", "key passed to SignWith if snapshots are signed")
+	flag.Parse()
+	if len(*dsn) == 0 || (len(*id) == 0 && !*verify) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if len(*secret) != 0 {
+		plugins.SetKeyring(plugins.NewKeyring(*keyId, flow.NewAES256Encryptor([]byte(*secret), strings.Split(*encrypt, ",")...)))
+	}
+	db, err := gorm.Open(mysql.Open(*dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		fail(err)
+	}
+	suspend := plugins.NewSuspendPlugin(db)
+	if len(*tenant) != 0 {
+		suspend = suspend.Tenant(*tenant)
+	}
+	if len(*blobs) != 0 {
+		store, err := plugins.NewFileBlobStore(*blobs)
+		if err != nil {
+			fail(err)
+		}
+		// only loads blobs, the threshold never applies
+		suspend = suspend.OffloadAbove(0, store)
+	}
+	if len(*sign) != 0 {
+		suspend = suspend.SignWith([]byte(*sign))
+	}
+	if *verify {
+		verifyAll(suspend)
+		return
+	}
+	views, err := suspend.Inspect(*id)
+	if err != nil {
+		fail(err)
+	}
+	switch *format {
+	case "json":
+		err = plugins.WriteCheckpointsJSON(os.Stdout, views)
+	case "table":
+		err = plugins.WriteCheckpointsTable(os.Stdout, views)
+	default:
+		err = fmt.Errorf("unknown format: %s", *format)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func verifyAll(suspend plugins.SuspendPlugin) {
+	corrupted, err := suspend.VerifyCheckpoints(0)
+	for _, c := range corrupted {
+		fmt.Println(c.Error())
+	}
+	if err != nil {
+		fail(err)
+	}
+	if len(corrupted) != 0 {
+		os.Exit(1)
+	}
+	fmt.Println("all checkpoints are intact")
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
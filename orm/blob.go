@@ -0,0 +1,232 @@
+package orm
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// snapshots written by the engine are gzip streams, which never start with storedMagic,
+// so rows saved before compression and offloading are read as they are.
+var storedMagic = []byte("LFS")
+
+const (
+	// compressedFormat is only read, snapshots are no longer compressed again once gzipped by the engine
+	compressedFormat byte = 'z'
+	offloadedFormat  byte = 'b'
+)
+
+// BlobStore keeps snapshots offloaded from checkpoint rows.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+type fileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore stores each snapshot as a file under dir.
+func NewFileBlobStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileBlobStore{dir: dir}, nil
+}
+
+func (f *fileBlobStore) Put(key string, data []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	// written to a temporary file first, so that a crash never leaves a truncated blob behind
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *fileBlobStore) Get(key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (f *fileBlobStore) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *fileBlobStore) path(key string) (string, error) {
+	if len(key) == 0 || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(f.dir, key), nil
+}
+
+// OffloadAbove moves snapshots larger than size bytes to store, the row keeps only the blob key and its hash.
+func (s *suspendPlugin[C, R, PC, PR]) OffloadAbove(size int, store BlobStore) SuspendPlugin {
+	s.offloadAbove = size
+	s.blobs = store
+	return s
+}
+
+// store encodes the snapshot of engine into the row of cp.
+func (s *suspendPlugin[C, R, PC, PR]) store(cp *Checkpoint, snapshot []byte) error {
+	// the engine has gzipped the snapshot already, it is stored without compressing again
+	stored := snapshot
+	cp.BlobKey, cp.SnapshotHash, cp.body = "", "", nil
+	switch {
+	case s.dedup && len(stored) != 0:
+		hash := sha256.Sum256(stored)
+		cp.SnapshotHash = hex.EncodeToString(hash[:])
+		cp.body = stored
+		stored = header(dedupFormat, hash[:])
+	case s.blobs != nil && s.offloadAbove > 0 && len(stored) > s.offloadAbove:
+		hash := sha256.Sum256(stored)
+		// a rewritten snapshot gets a new key, so the row keeps a valid blob until its update commits
+		key := fmt.Sprintf("%s.%x", cp.Id, hash[:8])
+		if err := s.blobs.Put(key, stored); err != nil {
+			return err
+		}
+		cp.BlobKey = key
+		stored = header(offloadedFormat, hash[:])
+	}
+	cp.Snapshot = stored
+	cp.Digest = s.digest(cp.Id, stored)
+	cp.KeyId = currentKeyId()
+	return nil
+}
+
+// load decodes the stored snapshot of cp back to the snapshot of engine in place.
+func (s *suspendPlugin[C, R, PC, PR]) load(cp *Checkpoint) error {
+	format, body := parseStored(cp.Snapshot)
+	if format == dedupFormat {
+		data, ok, err := s.fetch(body)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return s.corruption(cp)
+		}
+		format, body = parseStored(data)
+	}
+	if format == offloadedFormat {
+		if s.blobs == nil {
+			return fmt.Errorf("no blob store to load Checkpoint[Name: %s, Id: %s]", cp.Name, cp.Id)
+		}
+		data, err := s.blobs.Get(cp.BlobKey)
+		if err != nil {
+			return err
+		}
+		if hash := sha256.Sum256(data); !bytes.Equal(hash[:], body) {
+			return s.corruption(cp)
+		}
+		format, body = parseStored(data)
+	}
+	switch format {
+	case 0:
+		cp.Snapshot = body
+	case compressedFormat:
+		snapshot, err := decompress(body)
+		if err != nil {
+			return fmt.Errorf("failed to decompress Checkpoint[Name: %s, Id: %s]: %w", cp.Name, cp.Id, err)
+		}
+		cp.Snapshot = snapshot
+	default:
+		return fmt.Errorf("unknown snapshot format %q of Checkpoint[Name: %s, Id: %s]", format, cp.Name, cp.Id)
+	}
+	cp.BlobKey, cp.SnapshotHash = "", ""
+	return nil
+}
+
+// dropBlobs deletes blobs by key, it is called after their rows are deleted or rewritten.
+func (s *suspendPlugin[C, R, PC, PR]) dropBlobs(keys ...string) {
+	if s.blobs == nil {
+		return
+	}
+	for _, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		if err := s.blobs.Delete(key); err != nil {
+			logger.Errorf("Failed to delete blob %s, error: %s", key, err.Error())
+		}
+	}
+}
+
+// references lists the blob keys and snapshot hashes of the checkpoints matched by query.
+func (s *suspendPlugin[C, R, PC, PR]) references(query *gorm.DB) (blobKeys []string, hashes []string, err error) {
+	var refs []Checkpoint
+	err = query.Model(PC(new(C))).
+		Select("blob_key", "snapshot_hash").
+		Where("blob_key <> '' OR snapshot_hash <> ''").
+		Find(&refs).Error
+	for _, ref := range refs {
+		if len(ref.BlobKey) != 0 {
+			blobKeys = append(blobKeys, ref.BlobKey)
+		}
+		if len(ref.SnapshotHash) != 0 {
+			hashes = append(hashes, ref.SnapshotHash)
+		}
+	}
+	return
+}
+
+func header(format byte, body []byte) []byte {
+	stored := make([]byte, 0, len(storedMagic)+1+len(body))
+	stored = append(stored, storedMagic...)
+	stored = append(stored, format)
+	return append(stored, body...)
+}
+
+// parseStored returns format 0 for the snapshots written by the engine.
+func parseStored(stored []byte) (byte, []byte) {
+	if len(stored) <= len(storedMagic) || !bytes.HasPrefix(stored, storedMagic) {
+		return 0, stored
+	}
+	return stored[len(storedMagic)], stored[len(storedMagic)+1:]
+}
+
+// decompress gzips the gob stream of the rows that were deflated again, since the engine only reads gzip.
+func decompress(body []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(body))
+	defer reader.Close()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := io.Copy(writer, reader); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
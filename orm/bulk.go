@@ -0,0 +1,190 @@
+package orm
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	BulkSucceeded = "success"
+	BulkFailed    = "failed"
+	BulkSkipped   = "skipped"
+)
+
+// BulkFilter selects the idle recover records to recover in bulk, zero fields match all.
+type BulkFilter struct {
+	Name          string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Step selects the records that have a checkpoint of the failing step named Step.
+	Step string
+	// Concurrency is the number of flows recovering at the same time, at least 1.
+	Concurrency int
+	// Rate is the number of recoveries started per second, 0 means unlimited.
+	Rate float64
+}
+
+type BulkResult struct {
+	RecoverId string `json:"recover_id"`
+	RootUid   string `json:"root_uid"`
+	Name      string `json:"name"`
+	// Result is success, failed if the flow failed again, or skipped if the record is claimed by another worker or expired.
+	Result   string        `json:"result"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type BulkReport struct {
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Skipped   int           `json:"skipped"`
+	Results   []*BulkResult `json:"results"`
+}
+
+// RecoverBulk recovers the idle recover records selected by filter in the order they were created,
+// and reports the result of each record. It returns after all recoveries finish.
+// Like RecoverOnce it is an operator-wide sweep, it selects the records of every tenant unless called on a view
+// returned by Tenant, and each record is recovered within the tenant it belongs to.
+func (s *suspendPlugin[C, R, PC, PR]) RecoverBulk(filter BulkFilter) (*BulkReport, error) {
+	query := s.Where("status = ?", flow.RecoverIdle)
+	if len(s.tenantId) != 0 {
+		query = query.Where("tenant_id = ?", s.tenantId)
+	}
+	if len(filter.Name) != 0 {
+		query = query.Where("name = ?", filter.Name)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		query = query.Where("created_at >= ?", filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		query = query.Where("created_at < ?", filter.CreatedBefore)
+	}
+	if len(filter.Step) != 0 {
+		failing := s.Model(PC(new(C))).
+			Select("recover_id").
+			Where("scope = ? AND name = ?", flow.StepScope, filter.Step)
+		query = query.Where("recover_id IN (?)", failing)
+	}
+	var records []PR
+	if err := query.Order("created_at").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	report := &BulkReport{Total: len(records), Results: make([]*BulkResult, len(records))}
+	concurrency := filter.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var throttle <-chan time.Time
+	if filter.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / filter.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	slots := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for i, record := range records {
+		if throttle != nil && i != 0 {
+			<-throttle
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, record PR) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			report.Results[i] = s.recoverBulk(record)
+		}(i, record)
+	}
+	wg.Wait()
+	for _, result := range report.Results {
+		switch result.Result {
+		case BulkSucceeded:
+			report.Succeeded++
+		case BulkFailed:
+			report.Failed++
+		default:
+			report.Skipped++
+		}
+	}
+	return report, nil
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) recoverBulk(record PR) *BulkResult {
+	result := &BulkResult{
+		RecoverId: record.GetRecoverId(),
+		RootUid:   record.GetRootUid(),
+		Name:      record.GetName(),
+		Result:    BulkSucceeded,
+	}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+	err := s.claim(unscoped, record.GetRecoverId(), true, nil)
+	if err == nil {
+		if _, err = s.recoverAs(record); err != nil {
+			// the record stays idle only if recovery failed before re-execution, let it be claimed again,
+			// unclaim leaves it alone once re-execution has moved it out of idle
+			if err := s.unclaim(record); err != nil {
+				logger.Errorf("Release claim of RecoverRecord[RootUid: %s, RecoverId: %s] failed, error: %s",
+					record.GetRootUid(), record.GetRecoverId(), err.Error())
+			}
+		}
+	}
+	if err != nil {
+		result.Result = BulkFailed
+		if errors.Is(err, ErrAlreadyClaimed) || errors.Is(err, ErrRecordExpired) {
+			result.Result = BulkSkipped
+		}
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// WriteBulkReportJSON writes the report of bulk recovery to w as indented JSON.
+func WriteBulkReportJSON(w io.Writer, report *BulkReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// RecoverBulkCommand parses args as the flags of bulk recovery, recovers the selected records with plugin
+// and writes the report to w as JSON. Flows are only recovered by the binary that registers them,
+// so call it from your own program, for example when it is started with a recover subcommand.
+//
+//	-name flow -after 2024-01-02T15:04:05Z -before 2024-01-02T16:04:05Z -step step -concurrency 4 -rate 10
+func RecoverBulkCommand(plugin SuspendPlugin, args []string, w io.Writer) (*BulkReport, error) {
+	flags := flag.NewFlagSet("recover", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the flows to recover")
+	after := flags.String("after", "", "recover the records created at or after the RFC3339 time")
+	before := flags.String("before", "", "recover the records created before the RFC3339 time")
+	step := flags.String("step", "", "recover the records whose step named step failed")
+	concurrency := flags.Int("concurrency", 1, "number of flows recovering at the same time")
+	rate := flags.Float64("rate", 0, "number of recoveries started per second, 0 means unlimited")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	filter := BulkFilter{Name: *name, Step: *step, Concurrency: *concurrency, Rate: *rate}
+	var err error
+	if len(*after) != 0 {
+		if filter.CreatedAfter, err = time.Parse(time.RFC3339, *after); err != nil {
+			return nil, fmt.Errorf("invalid -after: %w", err)
+		}
+	}
+	if len(*before) != 0 {
+		if filter.CreatedBefore, err = time.Parse(time.RFC3339, *before); err != nil {
+			return nil, fmt.Errorf("invalid -before: %w", err)
+		}
+	}
+	report, err := plugin.RecoverBulk(filter)
+	if err != nil {
+		return nil, err
+	}
+	return report, WriteBulkReportJSON(w, report)
+}
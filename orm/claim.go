@@ -0,0 +1,157 @@
+package orm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	ErrAlreadyClaimed = errors.New("recover record is claimed by another worker")
+)
+
+// ClaimedError reports the worker holding a recover record and when its claim expires, it matches ErrAlreadyClaimed.
+type ClaimedError struct {
+	Owner     string
+	ExpiresAt time.Time
+}
+
+func (e *ClaimedError) Error() string {
+	return fmt.Sprintf("%s: held by %s until %s", ErrAlreadyClaimed.Error(), e.Owner, e.ExpiresAt.Format(time.RFC3339))
+}
+
+func (e *ClaimedError) Is(target error) bool {
+	return target == ErrAlreadyClaimed
+}
+
+const defaultLease = 5 * time.Minute
+
+// ClaimLease sets how long a claim holds without renewal, a claim whose lease expires can be taken over by other workers.
+// The lease is renewed while the flow is recovering, a lease not greater than 0 keeps the default.
+func (s *suspendPlugin[C, R, PC, PR]) ClaimLease(lease time.Duration) SuspendPlugin {
+	if lease > 0 {
+		s.lease = lease
+	}
+	return s
+}
+
+// Claim takes the recover record for current worker, a *ClaimedError is returned if another worker holds it.
+func (s *suspendPlugin[C, R, PC, PR]) Claim(recoverId string) error {
+	scope, err := s.tenancy.scoped(s.tenantId, recoverId)
+	if err != nil {
+		return err
+	}
+	return s.claim(scope, recoverId, true, nil)
+}
+
+// Release gives up the claim of an idle recover record held by current worker.
+func (s *suspendPlugin[C, R, PC, PR]) Release(recoverId string) error {
+	query, err := s.tenancy.scope(s.Model(PR(new(R))), s.tenantId, recoverId)
+	if err != nil {
+		return err
+	}
+	return query.
+		Where("recover_id = ? AND status = ? AND claimed_by = ?", recoverId, flow.RecoverIdle, s.worker).
+		Updates(map[string]interface{}{"claimed_by": "", "lease_expires_at": nil}).Error
+}
+
+// claim compares and sets the owner of recover record, reentrant allows current worker to claim the record it holds again.
+// A *ClaimedError is returned if the record can not be claimed.
+func (s *suspendPlugin[C, R, PC, PR]) claim(scope func(db *gorm.DB) *gorm.DB, recoverId string, reentrant bool, updates map[string]interface{}) error {
+	now := time.Now()
+	owner := "claimed_by IS NULL OR claimed_by = '' OR lease_expires_at < ?"
+	args := []interface{}{flow.RecoverIdle, now}
+	if reentrant {
+		owner += " OR claimed_by = ?"
+		args = append(args, s.worker)
+	}
+	args = append(args, flow.RecoverRunning, now)
+	values := map[string]interface{}{
+		"claimed_by":       s.worker,
+		"claimed_at":       now,
+		"lease_expires_at": now.Add(s.lease),
+	}
+	for k, v := range updates {
+		values[k] = v
+	}
+	// a running record is taken over only if its recoverer stops renewing the lease
+	claimed, err := s.transit(recoverId, func(db *gorm.DB) *gorm.DB {
+		return scope(db).Where("(status = ? AND ("+owner+")) OR (status = ? AND lease_expires_at < ?)", args...)
+	}, values)
+	if err != nil || claimed {
+		return err
+	}
+	holder := PR(new(R))
+	if err = scope(s.DB).Where("recover_id = ?", recoverId).First(holder).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return claimedBy(holder.recordModel())
+}
+
+func claimedBy(record *RecoverRecord) *ClaimedError {
+	claimed := &ClaimedError{Owner: record.ClaimedBy}
+	if record.LeaseExpiresAt != nil {
+		claimed.ExpiresAt = *record.LeaseExpiresAt
+	}
+	return claimed
+}
+
+// unclaim releases the claim of record held by current worker, scoped to the tenant of record.
+func (s *suspendPlugin[C, R, PC, PR]) unclaim(record PR) error {
+	tenantId := s.tenantId
+	if len(tenantId) == 0 {
+		tenantId = record.recordModel().TenantId
+	}
+	query, err := s.tenancy.scope(s.Model(PR(new(R))), tenantId, record.GetRecoverId())
+	if err != nil {
+		return err
+	}
+	return query.
+		Where("recover_id = ? AND status = ? AND claimed_by = ?", record.GetRecoverId(), flow.RecoverIdle, s.worker).
+		Updates(map[string]interface{}{"claimed_by": "", "lease_expires_at": nil}).Error
+}
+
+// renew extends the lease of the running record held by current worker until the record stops running.
+// It is started by UpdateRecordStatus, so flows recovered through flow.RecoverFlow are renewed as well.
+func (s *suspendPlugin[C, R, PC, PR]) renew(recoverId string) {
+	s.stopRenew(recoverId)
+	done := make(chan struct{})
+	s.renewals.Store(recoverId, done)
+	interval := s.lease / 3
+	if interval <= 0 {
+		interval = s.lease
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := s.Model(PR(new(R))).
+					Where("recover_id = ? AND claimed_by = ? AND status = ?", recoverId, s.worker, flow.RecoverRunning).
+					Update("lease_expires_at", time.Now().Add(s.lease)).Error
+				if err != nil {
+					logger.Errorf("Renew lease of RecoverRecord[RecoverId: %s] failed, error: %s", recoverId, err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// stopRenew stops renewing the lease of recoverId once its recovery finishes.
+func (s *suspendPlugin[C, R, PC, PR]) stopRenew(recoverId string) {
+	if done, loaded := s.renewals.LoadAndDelete(recoverId); loaded {
+		close(done.(chan struct{}))
+	}
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) heldByOther(record *RecoverRecord) bool {
+	if len(record.ClaimedBy) == 0 || record.ClaimedBy == s.worker {
+		return false
+	}
+	return record.LeaseExpiresAt != nil && record.LeaseExpiresAt.After(time.Now())
+}
@@ -0,0 +1,112 @@
+package orm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sort"
+	"time"
+)
+
+const dedupFormat byte = 'd'
+
+// SnapshotBlob is a snapshot body shared by the checkpoints referencing its hash.
+type SnapshotBlob struct {
+	Hash      string    `gorm:"column:hash;type:varchar(64);primaryKey"`
+	Data      []byte    `gorm:"column:data;type:longblob"`
+	RefCount  int       `gorm:"column:ref_count"`
+	CreatedAt time.Time `gorm:"type:datetime"`
+}
+
+// DeduplicateSnapshots stores each distinct snapshot once in snapshot_blobs, checkpoints reference it by hash.
+// Blobs are deleted once no checkpoint references them. Snapshots are deduplicated instead of offloaded.
+func (s *suspendPlugin[C, R, PC, PR]) DeduplicateSnapshots() SuspendPlugin {
+	s.dedup = true
+	return s
+}
+
+// retain references the snapshot bodies of cps, it must run in the transaction saving cps.
+// References are added in the order of hash, so that concurrent saves lock the blobs in the same order.
+func (s *suspendPlugin[C, R, PC, PR]) retain(tx *gorm.DB, cps ...*Checkpoint) error {
+	blobs := make(map[string]*SnapshotBlob)
+	for _, cp := range cps {
+		if len(cp.SnapshotHash) == 0 {
+			continue
+		}
+		if blob, exist := blobs[cp.SnapshotHash]; exist {
+			blob.RefCount++
+			continue
+		}
+		blobs[cp.SnapshotHash] = &SnapshotBlob{Hash: cp.SnapshotHash, Data: cp.body, RefCount: 1, CreatedAt: time.Now()}
+	}
+	sorted := make([]*SnapshotBlob, 0, len(blobs))
+	for _, blob := range blobs {
+		sorted = append(sorted, blob)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Hash < sorted[j].Hash
+	})
+	for _, blob := range sorted {
+		if err := s.reference(tx, blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reference inserts blob, or adds its references to the saved one.
+// The saved blob may be released by another transaction in between, then it is inserted again.
+func (s *suspendPlugin[C, R, PC, PR]) reference(tx *gorm.DB, blob *SnapshotBlob) error {
+	for {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(blob)
+		if result.Error != nil || result.RowsAffected != 0 {
+			return result.Error
+		}
+		result = tx.Model(&SnapshotBlob{}).
+			Where("hash = ?", blob.Hash).
+			Update("ref_count", gorm.Expr("ref_count + ?", blob.RefCount))
+		if result.Error != nil || result.RowsAffected != 0 {
+			return result.Error
+		}
+	}
+}
+
+// release drops a reference per hash, and deletes the bodies no longer referenced.
+func (s *suspendPlugin[C, R, PC, PR]) release(tx *gorm.DB, hashes ...string) error {
+	counts := make(map[string]int)
+	for _, hash := range hashes {
+		if len(hash) != 0 {
+			counts[hash]++
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	released := make([]string, 0, len(counts))
+	for hash := range counts {
+		released = append(released, hash)
+	}
+	// locked in the same order as retain
+	sort.Strings(released)
+	for _, hash := range released {
+		err := tx.Model(&SnapshotBlob{}).
+			Where("hash = ?", hash).
+			Update("ref_count", gorm.Expr("ref_count - ?", counts[hash])).Error
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Where("hash IN ? AND ref_count <= 0", released).Delete(&SnapshotBlob{}).Error
+}
+
+// fetch loads the body referenced by hash, ok is false if it does not match its hash.
+func (s *suspendPlugin[C, R, PC, PR]) fetch(hash []byte) (data []byte, ok bool, err error) {
+	blob := &SnapshotBlob{}
+	if err = s.Where("hash = ?", hex.EncodeToString(hash)).First(blob).Error; err != nil {
+		return nil, false, err
+	}
+	sum := sha256.Sum256(blob.Data)
+	return blob.Data, bytes.Equal(sum[:], hash), nil
+}
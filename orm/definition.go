@@ -0,0 +1,340 @@
+package orm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrDefinitionChanged = errors.New("flow definition changed since suspension")
+)
+
+// StepRename maps a step saved in checkpoints to the step that replaces it in the current definition.
+type StepRename struct {
+	Process string `json:"process"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// MigrationHook is called when the definition saved with a recover record differs from the current one,
+// the returned renames are applied to the checkpoints before the engine loads them.
+// Returning an error refuses the recovery.
+type MigrationHook func(diff *DefinitionDiff) ([]StepRename, error)
+
+// DefinitionDiff describes how a flow changed since it was suspended, steps are named as process/step.
+type DefinitionDiff struct {
+	Name             string          `json:"name"`
+	Previous         *FlowDefinition `json:"previous"`
+	Current          *FlowDefinition `json:"current"`
+	AddedProcesses   []string        `json:"added_processes"`
+	RemovedProcesses []string        `json:"removed_processes"`
+	AddedSteps       []string        `json:"added_steps"`
+	RemovedSteps     []string        `json:"removed_steps"`
+	// Rewired are the steps whose dependencies changed.
+	Rewired []string `json:"rewired"`
+}
+
+// DefinitionError refuses to recover a record whose flow definition changed incompatibly.
+type DefinitionError struct {
+	RecoverId string
+	Diff      *DefinitionDiff
+	// Unresolved are the checkpoints that match no process or step of the current definition.
+	Unresolved []string
+}
+
+func (e *DefinitionError) Error() string {
+	msg := fmt.Sprintf("%s: RecoverRecord[Name: %s, RecoverId: %s]\n%s", ErrDefinitionChanged.Error(), e.Diff.Name, e.RecoverId, e.Diff)
+	if len(e.Unresolved) != 0 {
+		msg += fmt.Sprintf("unresolved checkpoints: %s\n", strings.Join(e.Unresolved, ", "))
+	}
+	return msg
+}
+
+func (e *DefinitionError) Unwrap() error {
+	return ErrDefinitionChanged
+}
+
+type definition struct {
+	*FlowDefinition
+	fingerprint string
+}
+
+var (
+	defineOnce sync.Once
+	// defined holds the definition of each flow captured from its first run in this process.
+	defined sync.Map
+)
+
+// CheckDefinitions compares flows with the definitions saved with their recover records before recovering them,
+// a record whose definition fingerprint differs is refused with a *DefinitionError unless MigrateWith migrates it.
+// The current definition of a flow is captured from its runs through the runtime of engine,
+// so a record recovered before its flow first runs in this process is recovered unchecked, and the recovery captures it.
+func (s *suspendPlugin[C, R, PC, PR]) CheckDefinitions(flows ...*flow.FlowMeta) SuspendPlugin {
+	if s.checked == nil {
+		s.checked = make(map[string]bool, len(flows))
+	}
+	for _, meta := range flows {
+		s.checked[meta.Name()] = true
+	}
+	return s
+}
+
+// registerDefine captures the definition of every flow once it runs.
+func registerDefine() {
+	flow.DefaultCallback().BeforeFlow(false, func(wf flow.WorkFlow) (keepOn bool, err error) {
+		if _, exist := defined.Load(wf.Name()); exist {
+			return true, nil
+		}
+		if runtime, ok := wf.(flow.FinishedWorkFlow); ok {
+			current := defineFlow(runtime)
+			data, err := json.Marshal(current)
+			if err != nil {
+				return true, nil
+			}
+			defined.LoadOrStore(wf.Name(), &definition{FlowDefinition: current, fingerprint: fingerprint(string(data))})
+		}
+		return true, nil
+	})
+}
+
+// MigrateWith sets the hook that maps the steps of changed definitions to the current ones.
+func (s *suspendPlugin[C, R, PC, PR]) MigrateWith(hook MigrationHook) SuspendPlugin {
+	s.migration = hook
+	return s
+}
+
+// String renders the diff as human-readable text.
+func (d *DefinitionDiff) String() string {
+	var b strings.Builder
+	for _, change := range []struct {
+		title string
+		items []string
+	}{
+		{"added processes", d.AddedProcesses},
+		{"removed processes", d.RemovedProcesses},
+		{"added steps", d.AddedSteps},
+		{"removed steps", d.RemovedSteps},
+		{"rewired steps", d.Rewired},
+	} {
+		if len(change.items) != 0 {
+			fmt.Fprintf(&b, "%s: %s\n", change.title, strings.Join(change.items, ", "))
+		}
+	}
+	return b.String()
+}
+
+// migrate checks the checkpoints of recoverId against the current definition of their flow before the engine loads them.
+func (s *suspendPlugin[C, R, PC, PR]) migrate(recoverId string, checkpoints []PC) error {
+	if len(s.checked) == 0 {
+		return nil
+	}
+	record := PR(new(R))
+	err := s.Select("recover_id", "name", "definition", "fingerprint").
+		Where("recover_id = ?", recoverId).
+		First(record).Error
+	if err != nil {
+		return err
+	}
+	rcd := record.recordModel()
+	// records saved before definitions were captured can not be compared
+	if !s.checked[rcd.Name] || len(rcd.Fingerprint) == 0 {
+		return nil
+	}
+	value, exist := defined.Load(rcd.Name)
+	if !exist {
+		logger.Warnf("Definition of Flow[Name: %s] is not captured yet, RecoverRecord[RecoverId: %s] is recovered unchecked",
+			rcd.Name, recoverId)
+		return nil
+	}
+	current := value.(*definition)
+	if rcd.Fingerprint == current.fingerprint {
+		return nil
+	}
+	previous := &FlowDefinition{}
+	if err = json.Unmarshal([]byte(rcd.Definition), previous); err != nil {
+		return err
+	}
+	diff := diffDefinitions(previous, current.FlowDefinition)
+	if s.migration == nil {
+		return &DefinitionError{RecoverId: recoverId, Diff: diff}
+	}
+	renames, err := s.migration(diff)
+	if err != nil {
+		return fmt.Errorf("%w: migrate RecoverRecord[Name: %s, RecoverId: %s] failed: %s\n%s",
+			ErrDefinitionChanged, rcd.Name, recoverId, err.Error(), diff)
+	}
+	if err = renameSteps(checkpoints, renames); err != nil {
+		return err
+	}
+	if unresolved := resolve(checkpoints, current.FlowDefinition); len(unresolved) != 0 {
+		return &DefinitionError{RecoverId: recoverId, Diff: diff, Unresolved: unresolved}
+	}
+	return nil
+}
+
+// renameSteps renames step checkpoints and the results they saved in process checkpoints in place.
+func renameSteps[C any, PC CheckpointModel[C]](checkpoints []PC, renames []StepRename) error {
+	if len(renames) == 0 {
+		return nil
+	}
+	id2Name := make(map[string]string)
+	for _, cp := range checkpoints {
+		if cp.GetScope() == flow.ProcessScope {
+			id2Name[cp.GetUid()] = cp.GetName()
+		}
+	}
+	for _, cp := range checkpoints {
+		model := cp.checkpointModel()
+		switch model.Scope {
+		case flow.StepScope:
+			for _, rename := range renames {
+				if rename.Process == id2Name[model.ParentUid] && rename.From == model.Name {
+					model.Name = rename.To
+					break
+				}
+			}
+		case flow.ProcessScope:
+			if len(model.Snapshot) == 0 {
+				continue
+			}
+			nodes, err := deserialize[map[string][]node](model.Snapshot)
+			if err != nil {
+				return err
+			}
+			renamed := false
+			for _, rename := range renames {
+				if rename.Process != model.Name {
+					continue
+				}
+				kept := make([]node, 0, len(nodes[rename.From]))
+				for _, n := range nodes[rename.From] {
+					if n.Path == resultPath {
+						nodes[rename.To] = append([]node{n}, nodes[rename.To]...)
+						renamed = true
+					} else {
+						kept = append(kept, n)
+					}
+				}
+				if len(kept) == 0 {
+					delete(nodes, rename.From)
+				} else {
+					nodes[rename.From] = kept
+				}
+			}
+			if !renamed {
+				continue
+			}
+			snapshot, err := serialize(nodes)
+			if err != nil {
+				return err
+			}
+			model.Snapshot = snapshot
+		}
+	}
+	return nil
+}
+
+// resolve lists the checkpoints that the engine would fail to load into current.
+func resolve[C any, PC CheckpointModel[C]](checkpoints []PC, current *FlowDefinition) []string {
+	steps := make(map[string]map[string]bool)
+	for _, process := range current.Processes {
+		steps[process.Name] = make(map[string]bool)
+		for _, step := range process.Steps {
+			steps[process.Name][step.Name] = true
+		}
+	}
+	id2Name := make(map[string]string)
+	unresolved := make([]string, 0)
+	for _, cp := range checkpoints {
+		if cp.GetScope() != flow.ProcessScope {
+			continue
+		}
+		id2Name[cp.GetUid()] = cp.GetName()
+		if _, exist := steps[cp.GetName()]; !exist {
+			unresolved = append(unresolved, cp.GetName())
+		}
+	}
+	for _, cp := range checkpoints {
+		if cp.GetScope() != flow.StepScope {
+			continue
+		}
+		process := id2Name[cp.GetParentUid()]
+		if !steps[process][cp.GetName()] {
+			unresolved = append(unresolved, process+"/"+cp.GetName())
+		}
+	}
+	sort.Strings(unresolved)
+	return unresolved
+}
+
+func diffDefinitions(previous, current *FlowDefinition) *DefinitionDiff {
+	diff := &DefinitionDiff{
+		Name:             current.Name,
+		Previous:         previous,
+		Current:          current,
+		AddedProcesses:   make([]string, 0),
+		RemovedProcesses: make([]string, 0),
+		AddedSteps:       make([]string, 0),
+		RemovedSteps:     make([]string, 0),
+		Rewired:          make([]string, 0),
+	}
+	before, after := flatten(previous), flatten(current)
+	for process := range after {
+		if _, exist := before[process]; !exist {
+			diff.AddedProcesses = append(diff.AddedProcesses, process)
+		}
+	}
+	for process, steps := range before {
+		if _, exist := after[process]; !exist {
+			diff.RemovedProcesses = append(diff.RemovedProcesses, process)
+		}
+		for step, depends := range steps {
+			name := process + "/" + step
+			now, exist := after[process][step]
+			switch {
+			case !exist:
+				diff.RemovedSteps = append(diff.RemovedSteps, name)
+			case strings.Join(depends, ",") != strings.Join(now, ","):
+				diff.Rewired = append(diff.Rewired, fmt.Sprintf("%s [%s] -> [%s]", name, strings.Join(depends, " "), strings.Join(now, " ")))
+			}
+		}
+	}
+	for process, steps := range after {
+		for step := range steps {
+			if _, exist := before[process][step]; !exist {
+				diff.AddedSteps = append(diff.AddedSteps, process+"/"+step)
+			}
+		}
+	}
+	for _, items := range [][]string{diff.AddedProcesses, diff.RemovedProcesses, diff.AddedSteps, diff.RemovedSteps, diff.Rewired} {
+		sort.Strings(items)
+	}
+	return diff
+}
+
+func flatten(d *FlowDefinition) map[string]map[string][]string {
+	flat := make(map[string]map[string][]string, len(d.Processes))
+	for _, process := range d.Processes {
+		flat[process.Name] = make(map[string][]string, len(process.Steps))
+		for _, step := range process.Steps {
+			flat[process.Name][step.Name] = step.Depends
+		}
+	}
+	return flat
+}
+
+// fingerprint is empty for the records saved before definitions were captured.
+func fingerprint(definition string) string {
+	if len(definition) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(definition))
+	return hex.EncodeToString(sum[:])
+}
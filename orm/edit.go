@@ -0,0 +1,242 @@
+package orm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"reflect"
+	"time"
+)
+
+var (
+	ErrNotEditable = errors.New("checkpoint can not be edited")
+)
+
+type EditOp string
+
+const (
+	// SetOp sets the value on top of the existing ones, values visible only to some steps are kept.
+	SetOp EditOp = "set"
+	// OverrideOp replaces all values of the key with the value.
+	OverrideOp EditOp = "override"
+	// DeleteOp deletes all values of the key.
+	DeleteOp EditOp = "delete"
+)
+
+// ContextEdit is a change to the context that a checkpoint restores.
+type ContextEdit struct {
+	Op    EditOp `json:"op"`
+	Key   string `json:"key"`
+	Value any    `json:"-"`
+}
+
+// CheckpointAudit records an edit of checkpoint, values are not recorded since they may be sensitive.
+type CheckpointAudit struct {
+	Id               uint      `gorm:"primaryKey;autoIncrement"`
+	CheckpointId     string    `gorm:"type:varchar(64);index"`
+	RecoverId        string    `gorm:"type:varchar(64);index"`
+	RootUid          string    `gorm:"type:varchar(64);index"`
+	Version          uint      `gorm:"column:version"`
+	Operator         string    `gorm:"type:varchar(255)"`
+	Reason           string    `gorm:"type:varchar(1024)"`
+	Changes          string    `gorm:"type:text"`
+	PreviousSnapshot []byte    `gorm:"column:previous_snapshot"`
+	TenantId         string    `gorm:"type:varchar(64);index"`
+	CreatedAt        time.Time `gorm:"type:datetime"`
+}
+
+func SetKey(key string, value any) ContextEdit {
+	return ContextEdit{Op: SetOp, Key: key, Value: value}
+}
+
+func OverrideKey(key string, value any) ContextEdit {
+	return ContextEdit{Op: OverrideOp, Key: key, Value: value}
+}
+
+func DeleteKey(key string) ContextEdit {
+	return ContextEdit{Op: DeleteOp, Key: key}
+}
+
+// EditCheckpoint applies edits to the context restored by a flow or process checkpoint of an idle recover record,
+// the checkpoint is saved back as a new version and the previous snapshot is kept in checkpoint_audits.
+// Values must not be pointers, and types other than built-in ones must be registered by flow.RegisterType.
+func (s *suspendPlugin[C, R, PC, PR]) EditCheckpoint(checkpointId, operator, reason string, edits ...ContextEdit) error {
+	if err := checkEdits(edits); err != nil {
+		return err
+	}
+	scope, err := s.tenancy.scoped(s.tenantId, "")
+	if err != nil {
+		return err
+	}
+	changes, err := json.Marshal(edits)
+	if err != nil {
+		return err
+	}
+	replaced := ""
+	err = s.Transaction(func(tx *gorm.DB) error {
+		replaced, err = s.edit(tx, scope, checkpointId, operator, reason, string(changes), flow.RecoverIdle, edits)
+		return err
+	})
+	if err == nil {
+		s.dropBlobs(replaced)
+	}
+	return err
+}
+
+// edit applies edits to checkpointId in tx if its recover record is in status, it returns the blob key to drop after commit.
+func (s *suspendPlugin[C, R, PC, PR]) edit(tx *gorm.DB, scope func(*gorm.DB) *gorm.DB, checkpointId, operator, reason, changes string,
+	status uint8, edits []ContextEdit) (string, error) {
+	cp := PC(new(C))
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Scopes(scope).
+		Where("id = ?", checkpointId).
+		First(cp).Error
+	if err != nil {
+		return "", err
+	}
+	model := cp.checkpointModel()
+	if corrupted := s.verify(model); corrupted != nil {
+		return "", corrupted
+	}
+	replaced, hash := model.BlobKey, model.SnapshotHash
+	if err = s.load(model); err != nil {
+		return "", err
+	}
+	previous := model.Snapshot
+	// edited values are encrypted with the current key, so do the others
+	if err = s.rekey(model); err != nil {
+		return "", err
+	}
+	var current uint8
+	err = tx.Model(PR(new(R))).
+		Where("recover_id = ?", model.RecoverId).
+		Pluck("status", &current).Error
+	if err != nil {
+		return "", err
+	}
+	if current != status {
+		return "", fmt.Errorf("%w: recover record %s is in status %d instead of %d", ErrNotEditable, model.RecoverId, current, status)
+	}
+	var snapshot []byte
+	switch model.Scope {
+	case flow.FlowScope:
+		snapshot, err = editFlow(model.Snapshot, edits)
+	case flow.ProcessScope:
+		snapshot, err = editProc(model.Snapshot, edits)
+	default:
+		err = fmt.Errorf("%w: step checkpoint restores no context", ErrNotEditable)
+	}
+	if err != nil {
+		return "", err
+	}
+	audit := &CheckpointAudit{
+		CheckpointId:     model.Id,
+		RecoverId:        model.RecoverId,
+		RootUid:          model.RootUid,
+		Version:          model.Version + 1,
+		Operator:         operator,
+		Reason:           reason,
+		Changes:          changes,
+		PreviousSnapshot: previous,
+		TenantId:         model.TenantId,
+		CreatedAt:        time.Now(),
+	}
+	updates, err := s.stored(tx, model.Id, snapshot)
+	if err != nil {
+		return "", err
+	}
+	if err = s.release(tx, hash); err != nil {
+		return "", err
+	}
+	updates["version"] = audit.Version
+	updates["updated_at"] = time.Now()
+	if err = tx.Model(PC(new(C))).Where("id = ?", model.Id).Updates(updates).Error; err != nil {
+		return "", err
+	}
+	if replaced == updates["blob_key"] {
+		replaced = ""
+	}
+	return replaced, tx.Create(audit).Error
+}
+
+// checkEdits rejects pointer values, which the engine wraps before serializing but edits do not.
+func checkEdits(edits []ContextEdit) error {
+	for _, edit := range edits {
+		if edit.Op != DeleteOp && edit.Value != nil && reflect.TypeOf(edit.Value).Kind() == reflect.Pointer {
+			return fmt.Errorf("%w: value of %s is a pointer", ErrNotEditable, edit.Key)
+		}
+	}
+	return nil
+}
+
+// ListAudits lists the edits of the checkpoints of rootUid in the order they happened.
+func (s *suspendPlugin[C, R, PC, PR]) ListAudits(rootUid string) ([]*CheckpointAudit, error) {
+	query, err := s.tenancy.scope(s.Model(&CheckpointAudit{}), s.tenantId, rootUid)
+	if err != nil {
+		return nil, err
+	}
+	var audits []*CheckpointAudit
+	if err = query.Where("root_uid = ?", rootUid).Order("created_at, id").Find(&audits).Error; err != nil {
+		return nil, err
+	}
+	return audits, nil
+}
+
+func editFlow(snapshot []byte, edits []ContextEdit) ([]byte, error) {
+	maps := []map[string]any{{}, {}}
+	if len(snapshot) != 0 {
+		var err error
+		if maps, err = deserialize[[]map[string]any](snapshot); err != nil {
+			return nil, err
+		}
+	}
+	table := maps[0]
+	for _, edit := range edits {
+		if edit.Op == DeleteOp {
+			delete(table, edit.Key)
+			continue
+		}
+		value, err := encryptIfNeed(edit.Key, edit.Value)
+		if err != nil {
+			return nil, err
+		}
+		table[edit.Key] = value
+	}
+	return serialize(maps)
+}
+
+func editProc(snapshot []byte, edits []ContextEdit) ([]byte, error) {
+	nodes := make(map[string][]node)
+	if len(snapshot) != 0 {
+		var err error
+		if nodes, err = deserialize[map[string][]node](snapshot); err != nil {
+			return nil, err
+		}
+	}
+	for _, edit := range edits {
+		kept := make([]node, 0, len(nodes[edit.Key]))
+		for _, n := range nodes[edit.Key] {
+			// values kept by the engine are never edited
+			if edit.Op == SetOp || n.Path&(internalPath|resultPath) != 0 {
+				kept = append(kept, n)
+			}
+		}
+		if edit.Op != DeleteOp {
+			value, err := encryptIfNeed(edit.Key, edit.Value)
+			if err != nil {
+				return nil, err
+			}
+			// the head is the latest value, public path makes it visible to every step
+			kept = append([]node{{Value: value}}, kept...)
+		}
+		if len(kept) == 0 {
+			delete(nodes, edit.Key)
+			continue
+		}
+		nodes[edit.Key] = kept
+	}
+	return serialize(nodes)
+}
@@ -0,0 +1,115 @@
+package orm
+
+import (
+	"errors"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	// RecoverExpired marks the recover record that outlived its time-to-live, it can no longer be recovered.
+	RecoverExpired uint8 = 192
+)
+
+var (
+	ErrRecordExpired = errors.New("recover record has expired")
+)
+
+type expiry struct {
+	ttl      time.Duration
+	ttls     map[string]time.Duration
+	onExpire []func(expired *RecoverRecord) error
+}
+
+func newExpiry() *expiry {
+	return &expiry{ttls: make(map[string]time.Duration)}
+}
+
+// ExpireAfter expires the recover records of the named flows once they are older than ttl,
+// without names it applies to the flows that have no ttl of their own.
+func (s *suspendPlugin[C, R, PC, PR]) ExpireAfter(ttl time.Duration, names ...string) SuspendPlugin {
+	if len(names) == 0 {
+		s.expiry.ttl = ttl
+		return s
+	}
+	for _, name := range names {
+		s.expiry.ttls[name] = ttl
+	}
+	return s
+}
+
+// OnExpire calls hook with every expired recover record, so that it can be alerted or compensated.
+func (s *suspendPlugin[C, R, PC, PR]) OnExpire(hook func(expired *RecoverRecord) error) SuspendPlugin {
+	s.expiry.onExpire = append(s.expiry.onExpire, hook)
+	return s
+}
+
+// ExpireRecords moves the idle recover records that outlived their ttl to RecoverExpired,
+// at most recoverBatch records of each ttl are moved per call.
+func (s *suspendPlugin[C, R, PC, PR]) ExpireRecords() ([]*RecoverRecord, error) {
+	now := time.Now()
+	queries := make([]*gorm.DB, 0, len(s.expiry.ttls)+1)
+	configured := make([]string, 0, len(s.expiry.ttls))
+	for name, ttl := range s.expiry.ttls {
+		configured = append(configured, name)
+		if ttl > 0 {
+			queries = append(queries, s.Where("name = ? AND created_at < ?", name, now.Add(-ttl)))
+		}
+	}
+	if s.expiry.ttl > 0 {
+		query := s.Where("created_at < ?", now.Add(-s.expiry.ttl))
+		if len(configured) != 0 {
+			query = query.Where("name NOT IN ?", configured)
+		}
+		queries = append(queries, query)
+	}
+	expired := make([]*RecoverRecord, 0)
+	for _, query := range queries {
+		query = query.Where("status = ?", flow.RecoverIdle)
+		if len(s.tenantId) != 0 {
+			query = query.Where("tenant_id = ?", s.tenantId)
+		}
+		var records []PR
+		if err := query.Order("created_at").Limit(recoverBatch).Find(&records).Error; err != nil {
+			return expired, err
+		}
+		for _, record := range records {
+			moved, err := s.expire(record)
+			if err != nil {
+				return expired, err
+			}
+			if moved {
+				expired = append(expired, record.recordModel())
+			}
+		}
+	}
+	return expired, nil
+}
+
+// expire moves the idle record to RecoverExpired and calls hooks if this call moved it.
+func (s *suspendPlugin[C, R, PC, PR]) expire(record PR) (bool, error) {
+	moved, err := s.transit(record.GetRecoverId(), func(db *gorm.DB) *gorm.DB {
+		return db.Where("status = ?", flow.RecoverIdle)
+	}, map[string]interface{}{"status": RecoverExpired})
+	if err != nil || !moved {
+		return moved, err
+	}
+	rcd := record.recordModel()
+	rcd.Status = RecoverExpired
+	for _, hook := range s.expiry.onExpire {
+		if err = hook(rcd); err != nil {
+			logger.Errorf("OnExpire hook failed for RecoverRecord[Name: %s, RootUid: %s, RecoverId: %s], error: %s",
+				rcd.Name, rcd.RootUid, rcd.RecoverId, err.Error())
+		}
+	}
+	return true, nil
+}
+
+func (e *expiry) expired(record *RecoverRecord) bool {
+	ttl, exist := e.ttls[record.Name]
+	if !exist {
+		ttl = e.ttl
+	}
+	return ttl > 0 && time.Since(record.CreatedAt) > ttl
+}
@@ -0,0 +1,121 @@
+package orm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	ErrNotForkable = errors.New("recover record can not be forked")
+)
+
+// ForkRecovery copies the checkpoints and record of recoverId under a new root uid and recover id, and returns the new root uid.
+// overrides are applied to the flow context of the fork, the original record is left untouched.
+// The fork records its origin in forked_from and recovers independently, custom columns are copied as they are.
+func (s *suspendPlugin[C, R, PC, PR]) ForkRecovery(recoverId string, overrides ...ContextEdit) (string, error) {
+	if err := checkEdits(overrides); err != nil {
+		return "", err
+	}
+	query, err := s.tenancy.scope(s.DB, s.tenantId, recoverId)
+	if err != nil {
+		return "", err
+	}
+	origin := PR(new(R))
+	if err = query.Where("recover_id = ?", recoverId).First(origin).Error; err != nil {
+		return "", err
+	}
+	allowed := false
+	for _, status := range rewindable {
+		allowed = allowed || status == origin.GetStatus()
+	}
+	if !allowed {
+		return "", fmt.Errorf("%w: recover record %s is executing", ErrNotForkable, recoverId)
+	}
+	checkpoints, err := s.listCheckpoints(recoverId)
+	if err != nil {
+		return "", err
+	}
+	rootUid, forkId := uuid.NewString(), uuid.NewString()
+	uids := map[string]string{origin.GetRootUid(): rootUid}
+	for _, cp := range checkpoints {
+		if cp.GetScope() == flow.ProcessScope {
+			uids[cp.GetUid()] = uuid.NewString()
+		}
+	}
+	restorable := false
+	cps := make([]PC, len(checkpoints))
+	for i, cp := range checkpoints {
+		model := cp.checkpointModel()
+		if err = s.open(model); err != nil {
+			return "", err
+		}
+		snapshot := model.Snapshot
+		if model.Scope == flow.FlowScope && len(snapshot) != 0 {
+			restorable = true
+			if len(overrides) != 0 {
+				if snapshot, err = editFlow(snapshot, overrides); err != nil {
+					return "", err
+				}
+			}
+		}
+		clone := PC(new(C))
+		*clone = *cp
+		forked := clone.checkpointModel()
+		forked.Id = uuid.NewString()
+		forked.Uid = uids[model.Uid]
+		if len(forked.Uid) == 0 {
+			forked.Uid = uuid.NewString()
+		}
+		forked.RecoverId = forkId
+		forked.ParentUid = uids[model.ParentUid]
+		forked.RootUid = rootUid
+		forked.Version = 0
+		forked.CreatedAt, forked.UpdatedAt = time.Now(), time.Now()
+		if err = s.store(forked, snapshot); err != nil {
+			return "", err
+		}
+		cps[i] = clone
+	}
+	if !restorable {
+		return "", fmt.Errorf("%w: checkpoints of recover record %s have been collected", ErrNotForkable, recoverId)
+	}
+	record := PR(new(R))
+	*record = *origin
+	*record.recordModel() = RecoverRecord{
+		RootUid:     rootUid,
+		RecoverId:   forkId,
+		Status:      flow.RecoverIdle,
+		Name:        origin.GetName(),
+		Sequence:    1,
+		TenantId:    origin.recordModel().TenantId,
+		CreatedBy:   s.worker,
+		Definition:  origin.recordModel().Definition,
+		Fingerprint: origin.recordModel().Fingerprint,
+		ForkedFrom:  recoverId,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+	err = s.Transaction(func(tx *gorm.DB) error {
+		if err := s.retain(tx, models(cps)...); err != nil {
+			return err
+		}
+		if err := tx.CreateInBatches(&cps, s.saveBatch).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(record).Error; err != nil {
+			return err
+		}
+		return tx.Create(s.transition(record.recordModel(), 0, flow.RecoverIdle)).Error
+	})
+	if err != nil {
+		for _, cp := range cps {
+			s.dropBlobs(cp.checkpointModel().BlobKey)
+		}
+		return "", err
+	}
+	return rootUid, nil
+}
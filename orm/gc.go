@@ -0,0 +1,164 @@
+package orm
+
+import (
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/gorm"
+	"time"
+)
+
+// GCPolicy decides what happens to the checkpoints of a root once it is recovered successfully.
+type GCPolicy uint8
+
+const (
+	// KeepCheckpoints leaves checkpoints untouched.
+	KeepCheckpoints GCPolicy = iota
+	// CompactCheckpoints clears snapshots but keeps checkpoint rows.
+	CompactCheckpoints
+	// DeleteCheckpoints deletes checkpoint rows.
+	DeleteCheckpoints
+)
+
+const defaultGCBatch = 500
+
+// finished recover records never load their checkpoints again.
+var finished = []uint8{flow.RecoverSuccess, flow.RecoverFailed, RecoverDead, RecoverExpired}
+
+// CollectOnSuccess applies policy to all checkpoints of a root once it is recovered successfully.
+func (s *suspendPlugin[C, R, PC, PR]) CollectOnSuccess(policy GCPolicy) SuspendPlugin {
+	s.gcPolicy = policy
+	return s
+}
+
+// CollectGarbage deletes the checkpoints whose recover record finished for retention,
+// at most batch rows are deleted at once so that large tables are not locked for long.
+// It returns the number of checkpoints deleted.
+func (s *suspendPlugin[C, R, PC, PR]) CollectGarbage(retention time.Duration, batch int) (int64, error) {
+	if batch <= 0 {
+		batch = defaultGCBatch
+	}
+	return s.collectBefore(time.Now().Add(-retention), batch)
+}
+
+// PurgeRecords deletes the recover records finished for retention with their checkpoints, transitions and approvals,
+// at most batch records are deleted at once. It returns the number of recover records deleted.
+// Records of a root that has an unfinished record are kept since they count its failed attempts,
+// and audits of edited checkpoints are kept as they are.
+func (s *suspendPlugin[C, R, PC, PR]) PurgeRecords(retention time.Duration, batch int) (int64, error) {
+	if batch <= 0 {
+		batch = defaultGCBatch
+	}
+	before := time.Now().Add(-retention)
+	if _, err := s.collectBefore(before, batch); err != nil {
+		return 0, err
+	}
+	unfinished := s.Model(PR(new(R))).
+		Select("root_uid").
+		Where("status NOT IN ?", finished)
+	var total int64
+	for {
+		query := s.Model(PR(new(R))).
+			Where("status IN ? AND updated_at < ? AND root_uid NOT IN (?)", finished, before, unfinished)
+		if len(s.tenantId) != 0 {
+			query = query.Where("tenant_id = ?", s.tenantId)
+		}
+		var ids []string
+		if err := query.Limit(batch).Pluck("recover_id", &ids).Error; err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		err := s.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("recover_id IN ?", ids).Delete(&RecoverRecordTransition{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("recover_id IN ?", ids).Delete(&Approval{}).Error; err != nil {
+				return err
+			}
+			result := tx.Where("recover_id IN ?", ids).Delete(PR(new(R)))
+			total += result.RowsAffected
+			return result.Error
+		})
+		if err != nil {
+			return total, err
+		}
+		if len(ids) < batch {
+			return total, nil
+		}
+	}
+}
+
+// collectBefore deletes the checkpoints whose recover record finished before, batch rows at a time.
+func (s *suspendPlugin[C, R, PC, PR]) collectBefore(before time.Time, batch int) (int64, error) {
+	consumed := s.Model(PR(new(R))).
+		Select("recover_id").
+		Where("status IN ? AND updated_at < ?", finished, before)
+	if len(s.tenantId) != 0 {
+		consumed = consumed.Where("tenant_id = ?", s.tenantId)
+	}
+	var total int64
+	for {
+		var ids []string
+		err := s.Model(PC(new(C))).
+			Where("recover_id IN (?)", consumed).
+			Limit(batch).
+			Pluck("id", &ids).Error
+		if err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		blobKeys, hashes, err := s.references(s.Where("id IN ?", ids))
+		if err != nil {
+			return total, err
+		}
+		err = s.Transaction(func(tx *gorm.DB) error {
+			result := tx.Where("id IN ?", ids).Delete(PC(new(C)))
+			if result.Error != nil {
+				return result.Error
+			}
+			total += result.RowsAffected
+			return s.release(tx, hashes...)
+		})
+		if err != nil {
+			return total, err
+		}
+		s.dropBlobs(blobKeys...)
+		if len(ids) < batch {
+			return total, nil
+		}
+	}
+}
+
+// collect applies gc policy to the checkpoints of the root of recoverId.
+func (s *suspendPlugin[C, R, PC, PR]) collect(recoverId string) error {
+	if s.gcPolicy == KeepCheckpoints {
+		return nil
+	}
+	record := PR(new(R))
+	if err := s.Where("recover_id = ?", recoverId).First(record).Error; err != nil {
+		return err
+	}
+	blobKeys, hashes, err := s.references(s.Where("root_uid = ?", record.GetRootUid()))
+	if err != nil {
+		return err
+	}
+	err = s.Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("root_uid = ?", record.GetRootUid())
+		if s.gcPolicy == CompactCheckpoints {
+			err = query.Model(PC(new(C))).
+				Updates(map[string]interface{}{"snapshot": nil, "digest": "", "blob_key": "", "snapshot_hash": ""}).Error
+		} else {
+			err = query.Delete(PC(new(C))).Error
+		}
+		if err != nil {
+			return err
+		}
+		return s.release(tx, hashes...)
+	})
+	if err == nil {
+		s.dropBlobs(blobKeys...)
+	}
+	return err
+}
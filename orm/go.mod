@@ -4,11 +4,11 @@ go 1.18
 
 require (
 	github.com/Bilibotter/light-flow/flow v1.1.0
+	github.com/google/uuid v1.6.0
 	gorm.io/gorm v1.25.12
 )
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	golang.org/x/text v0.14.0 // indirect
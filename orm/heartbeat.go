@@ -0,0 +1,145 @@
+package orm
+
+import (
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+type keeper[PF any] struct {
+	running   sync.Map // flow id of running flows
+	heartbeat time.Duration
+	timeout   time.Duration
+	interval  time.Duration
+	onAbandon []func(abandoned PF) error
+	stop      chan struct{}
+	start     sync.Once
+	once      sync.Once
+}
+
+// Heartbeat refreshes last_heartbeat of running flows every interval.
+func (p *persistence[F, P, S, PF, PP, PS]) Heartbeat(interval time.Duration) PersistenceOf[PF] {
+	p.keeper.heartbeat = interval
+	return p
+}
+
+// Reaper reaps flows whose heartbeat has expired for timeout every interval,
+// heartbeat must be enabled on every instance with an interval well below timeout.
+func (p *persistence[F, P, S, PF, PP, PS]) Reaper(timeout, interval time.Duration) PersistenceOf[PF] {
+	p.keeper.timeout = timeout
+	p.keeper.interval = interval
+	return p
+}
+
+// OnAbandon calls hook with every abandoned flow, so that the run can be restarted or recovered.
+func (p *persistence[F, P, S, PF, PP, PS]) OnAbandon(hook func(abandoned PF) error) PersistenceOf[PF] {
+	p.keeper.onAbandon = append(p.keeper.onAbandon, hook)
+	return p
+}
+
+// Close stops heartbeat and reaper.
+func (p *persistence[F, P, S, PF, PP, PS]) Close() {
+	p.keeper.once.Do(func() {
+		close(p.keeper.stop)
+	})
+}
+
+// Reap marks the running flows whose heartbeat has expired for timeout as Abandoned,
+// so do their unfinished processes and steps.
+func (p *persistence[F, P, S, PF, PP, PS]) Reap(timeout time.Duration) ([]PF, error) {
+	deadline := time.Now().Add(-timeout)
+	var expired []PF
+	err := p.Model(PF(new(F))).
+		Where("status = ?", Begin).
+		Where("last_heartbeat < ? OR (last_heartbeat IS NULL AND created_at < ?)", deadline, deadline).
+		Find(&expired).Error
+	if err != nil {
+		return nil, err
+	}
+	abandoned := make([]PF, 0, len(expired))
+	for _, foo := range expired {
+		record := foo.flowRecord()
+		var reaped bool
+		err = p.Transaction(func(tx *gorm.DB) error {
+			// another reaper may have reaped it, or it may have heartbeat again
+			result := tx.Model(PF(new(F))).
+				Where("id = ? AND status = ?", record.Id, Begin).
+				Where("last_heartbeat < ? OR (last_heartbeat IS NULL AND created_at < ?)", deadline, deadline).
+				Updates(map[string]interface{}{"status": Abandoned, "updated_at": time.Now()})
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			reaped = true
+			if err := tx.Model(PP(new(P))).
+				Where("flow_id = ? AND status = ?", record.Id, Begin).
+				Updates(map[string]interface{}{"status": Abandoned, "updated_at": time.Now()}).Error; err != nil {
+				return err
+			}
+			return tx.Model(PS(new(S))).
+				Where("flow_id = ? AND status = ?", record.Id, Begin).
+				Updates(map[string]interface{}{"status": Abandoned, "updated_at": time.Now()}).Error
+		})
+		if err != nil {
+			return abandoned, err
+		}
+		if !reaped {
+			continue
+		}
+		record.Status = Abandoned
+		abandoned = append(abandoned, foo)
+		for _, hook := range p.keeper.onAbandon {
+			if err = hook(foo); err != nil {
+				logger.Errorf("OnAbandon hook failed for Flow[Name: %s, ID: %s], error: %s", record.Name, record.Id, err.Error())
+			}
+		}
+	}
+	return abandoned, nil
+}
+
+func (p *persistence[F, P, S, PF, PP, PS]) beat() error {
+	ids := make([]string, 0)
+	p.keeper.running.Range(func(key, _ any) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+	if len(ids) == 0 {
+		return nil
+	}
+	return p.Model(PF(new(F))).
+		Where("id IN ?", ids).
+		Update("last_heartbeat", time.Now()).Error
+}
+
+func (p *persistence[F, P, S, PF, PP, PS]) keepAlive() {
+	p.keeper.start.Do(p.startKeeper)
+}
+
+func (p *persistence[F, P, S, PF, PP, PS]) startKeeper() {
+	if p.keeper.heartbeat > 0 {
+		go p.schedule(p.keeper.heartbeat, func() {
+			if err := p.beat(); err != nil {
+				logger.Errorf("Heartbeat failed, error: %s", err.Error())
+			}
+		})
+	}
+	if p.keeper.interval > 0 {
+		go p.schedule(p.keeper.interval, func() {
+			if _, err := p.Reap(p.keeper.timeout); err != nil {
+				logger.Errorf("Reap abandoned flows failed, error: %s", err.Error())
+			}
+		})
+	}
+}
+
+func (p *persistence[F, P, S, PF, PP, PS]) schedule(interval time.Duration, task func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.keeper.stop:
+			return
+		case <-ticker.C:
+			task()
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package orm
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+// RecoverRecordTransition records a status change of recover record.
+type RecoverRecordTransition struct {
+	Id         uint      `gorm:"primaryKey;autoIncrement"`
+	RecoverId  string    `gorm:"type:varchar(64);index"`
+	RootUid    string    `gorm:"type:varchar(64);index"`
+	FromStatus uint8     `gorm:"column:from_status"`
+	ToStatus   uint8     `gorm:"column:to_status"`
+	Actor      string    `gorm:"type:varchar(255)"`
+	TenantId   string    `gorm:"type:varchar(64);index"`
+	CreatedAt  time.Time `gorm:"type:datetime"`
+}
+
+// sequenceRetries bounds how many times a suspension is saved again after another one took its sequence.
+const sequenceRetries = 5
+
+// rootSequenceIndex is the unique index on root_uid and sequence of recover records.
+const rootSequenceIndex = "idx_root_sequence"
+
+var errSequenceTaken = errors.New("sequence of recover record is taken")
+
+// sequence numbers the next recover record of rootUid, so that records created within a second are still ordered.
+// Concurrent saves of the same root may read the same number, the unique index on root_uid and sequence rejects all but one.
+func (s *suspendPlugin[C, R, PC, PR]) sequence(tx *gorm.DB, rootUid string) (uint, error) {
+	var latest uint
+	err := tx.Model(PR(new(R))).
+		Select("COALESCE(MAX(sequence), 0)").
+		Where("root_uid = ?", rootUid).
+		Scan(&latest).Error
+	if err != nil {
+		return 0, err
+	}
+	return latest + 1, nil
+}
+
+// sequenceTaken reports whether err violates the unique sequence of root, other duplicates are not retried.
+func sequenceTaken(err error) bool {
+	// the orm is not bound to a driver, so the violated index is matched by its name in the message,
+	// gorm.ErrDuplicatedKey translated by TranslateError names no index and is surfaced as is
+	return strings.Contains(err.Error(), rootSequenceIndex)
+}
+
+// renumber numbers the recover records saved before sequences were unique, so that the unique index can be created.
+func (s *suspendPlugin[C, R, PC, PR]) renumber() error {
+	migrator := s.Migrator()
+	if !migrator.HasTable(PR(new(R))) || !migrator.HasColumn(PR(new(R)), "sequence") ||
+		migrator.HasIndex(PR(new(R)), rootSequenceIndex) {
+		return nil
+	}
+	var roots []string
+	err := s.Model(PR(new(R))).
+		Distinct("root_uid").
+		Group("root_uid, sequence").
+		Having("COUNT(*) > 1").
+		Pluck("root_uid", &roots).Error
+	if err != nil {
+		return err
+	}
+	for _, rootUid := range roots {
+		var records []PR
+		if err = s.Where("root_uid = ?", rootUid).Order("sequence, created_at").Find(&records).Error; err != nil {
+			return err
+		}
+		err = s.Transaction(func(tx *gorm.DB) error {
+			for i, record := range records {
+				err := tx.Model(PR(new(R))).
+					Where("recover_id = ?", record.GetRecoverId()).
+					Update("sequence", i+1).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListRecoverRecords lists the recover records of rootUid from the earliest, each suspension leaves one.
+func (s *suspendPlugin[C, R, PC, PR]) ListRecoverRecords(rootUid string) ([]*RecoverRecord, error) {
+	query, err := s.tenancy.scope(s.Model(PR(new(R))), s.tenantId, rootUid)
+	if err != nil {
+		return nil, err
+	}
+	var records []*RecoverRecord
+	if err = query.Where("root_uid = ?", rootUid).Order("sequence, created_at").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ListTransitions lists the status changes of the recover records of rootUid in the order they happened.
+func (s *suspendPlugin[C, R, PC, PR]) ListTransitions(rootUid string) ([]*RecoverRecordTransition, error) {
+	query, err := s.tenancy.scope(s.Model(&RecoverRecordTransition{}), s.tenantId, rootUid)
+	if err != nil {
+		return nil, err
+	}
+	var transitions []*RecoverRecordTransition
+	if err = query.Where("root_uid = ?", rootUid).Order("created_at, id").Find(&transitions).Error; err != nil {
+		return nil, err
+	}
+	return transitions, nil
+}
+
+// transit updates the recover record matched by scope with updates, the status change is recorded in the same transaction.
+func (s *suspendPlugin[C, R, PC, PR]) transit(recoverId string, scope func(db *gorm.DB) *gorm.DB, updates map[string]interface{}) (bool, error) {
+	changed := false
+	err := s.Transaction(func(tx *gorm.DB) error {
+		current := PR(new(R))
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("recover_id = ?", recoverId).
+			First(current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		result := tx.Model(PR(new(R))).
+			Where("recover_id = ?", recoverId).
+			Scopes(scope).
+			Updates(updates)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		changed = true
+		status, ok := updates["status"].(uint8)
+		if !ok || status == current.GetStatus() {
+			return nil
+		}
+		return tx.Create(s.transition(current.recordModel(), current.GetStatus(), status)).Error
+	})
+	return changed, err
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) transition(record *RecoverRecord, from, to uint8) *RecoverRecordTransition {
+	return &RecoverRecordTransition{
+		RecoverId:  record.RecoverId,
+		RootUid:    record.RootUid,
+		FromStatus: from,
+		ToStatus:   to,
+		Actor:      s.worker,
+		TenantId:   record.TenantId,
+		CreatedAt:  time.Now(),
+	}
+}
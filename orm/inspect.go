@@ -0,0 +1,267 @@
+package orm
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	resultPath   uint64 = 1 << 62
+	internalPath uint64 = 1 << 63
+)
+
+const enginePkg = "github.com/Bilibotter/light-flow/flow"
+
+// SnapshotEntry is a context value that a checkpoint restores.
+type SnapshotEntry struct {
+	Key string `json:"key"`
+	// Visibility is public, restricted, result or internal,
+	// a restricted value is only visible to the steps set in Path.
+	Visibility string `json:"visibility"`
+	Path       uint64 `json:"path,omitempty"`
+	Value      any    `json:"value"`
+	Error      string `json:"error,omitempty"`
+}
+
+// CheckpointView is a checkpoint with its snapshot decrypted and decoded.
+type CheckpointView struct {
+	Id        string          `json:"id"`
+	Uid       string          `json:"uid"`
+	Name      string          `json:"name"`
+	ParentUid string          `json:"parent_uid,omitempty"`
+	RecoverId string          `json:"recover_id"`
+	Scope     string          `json:"scope"`
+	Entries   []SnapshotEntry `json:"entries"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// Inspect decodes the checkpoints of a recover id, or of the latest recover record if id is a root uid.
+// Values encrypted by the encryptor of the engine are decrypted.
+func (s *suspendPlugin[C, R, PC, PR]) Inspect(id string) ([]*CheckpointView, error) {
+	recoverId, err := s.resolveRecoverId(id)
+	if err != nil {
+		return nil, err
+	}
+	checkpoints, err := s.listCheckpoints(recoverId)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]*CheckpointView, len(checkpoints))
+	for i, cp := range checkpoints {
+		// corrupted snapshots are still loaded and decoded as far as possible
+		model := cp.checkpointModel()
+		failures := make([]string, 0, 2)
+		if corrupted := s.verify(model); corrupted != nil {
+			failures = append(failures, corrupted.Error())
+		}
+		failure := s.load(model)
+		if failure == nil {
+			failure = s.rekey(model)
+		}
+		if failure != nil {
+			failures = append(failures, failure.Error())
+		}
+		views[i] = inspectCheckpoint(cp)
+		if len(views[i].Error) != 0 {
+			failures = append(failures, views[i].Error)
+		}
+		views[i].Error = strings.Join(failures, "; ")
+	}
+	sort.SliceStable(views, func(i, j int) bool {
+		if views[i].Scope != views[j].Scope {
+			return scopeOrder(views[i].Scope) < scopeOrder(views[j].Scope)
+		}
+		return views[i].Name < views[j].Name
+	})
+	return views, nil
+}
+
+// resolveRecoverId returns id itself if it is a recover id, otherwise the recover id of the latest record of root id.
+func (s *suspendPlugin[C, R, PC, PR]) resolveRecoverId(id string) (string, error) {
+	query, err := s.tenancy.scope(s.Model(PR(new(R))), s.tenantId, id)
+	if err != nil {
+		return "", err
+	}
+	var count int64
+	if err = query.Where("recover_id = ?", id).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count != 0 {
+		return id, nil
+	}
+	query, _ = s.tenancy.scope(s.DB, s.tenantId, id)
+	record := PR(new(R))
+	if err = query.Where("root_uid = ?", id).Order("sequence DESC, created_at DESC").First(record).Error; err != nil {
+		return "", err
+	}
+	return record.GetRecoverId(), nil
+}
+
+// WriteCheckpointsJSON writes the inspected checkpoints to w as indented JSON.
+func WriteCheckpointsJSON(w io.Writer, views []*CheckpointView) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(views)
+}
+
+// WriteCheckpointsTable writes the inspected checkpoints to w as a table, one context value per row.
+func WriteCheckpointsTable(w io.Writer, views []*CheckpointView) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCOPE\tNAME\tUID\tKEY\tVISIBILITY\tVALUE")
+	for _, view := range views {
+		if len(view.Error) != 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\terror: %s\n", view.Scope, view.Name, view.Uid, view.Error)
+		}
+		if len(view.Entries) == 0 && len(view.Error) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\n", view.Scope, view.Name, view.Uid)
+			continue
+		}
+		for _, entry := range view.Entries {
+			value := fmt.Sprintf("%v", entry.Value)
+			if len(entry.Error) != 0 {
+				value = "error: " + entry.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", view.Scope, view.Name, view.Uid, entry.Key, entry.Visibility, value)
+		}
+	}
+	return tw.Flush()
+}
+
+func inspectCheckpoint(cp flow.CheckPoint) *CheckpointView {
+	view := &CheckpointView{
+		Id:        cp.GetId(),
+		Uid:       cp.GetUid(),
+		Name:      cp.GetName(),
+		ParentUid: cp.GetParentUid(),
+		RecoverId: cp.GetRecoverId(),
+		Entries:   make([]SnapshotEntry, 0),
+	}
+	var err error
+	switch cp.GetScope() {
+	case flow.FlowScope:
+		view.Scope = "flow"
+		view.Entries, err = inspectFlow(cp.GetSnapshot())
+	case flow.ProcessScope:
+		view.Scope = "process"
+		view.Entries, err = inspectProc(cp.GetSnapshot())
+	case flow.StepScope:
+		// steps restore nothing but their status
+		view.Scope = "step"
+	default:
+		view.Scope = fmt.Sprintf("unknown(%d)", cp.GetScope())
+	}
+	if err != nil {
+		view.Error = err.Error()
+	}
+	return view
+}
+
+func inspectFlow(snapshot []byte) ([]SnapshotEntry, error) {
+	if len(snapshot) == 0 {
+		return []SnapshotEntry{}, nil
+	}
+	maps, err := deserialize[[]map[string]any](snapshot)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]SnapshotEntry, 0)
+	for i, m := range maps {
+		for key, value := range m {
+			entry := SnapshotEntry{Key: key, Visibility: "public", Value: plain(value)}
+			if i == 0 {
+				entry = decryptEntry(entry)
+			} else {
+				entry.Visibility = "internal"
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func inspectProc(snapshot []byte) ([]SnapshotEntry, error) {
+	if len(snapshot) == 0 {
+		return []SnapshotEntry{}, nil
+	}
+	nodes, err := deserialize[map[string][]node](snapshot)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]SnapshotEntry, 0)
+	for key, list := range nodes {
+		for _, n := range list {
+			entry := SnapshotEntry{Key: key, Path: n.Path, Value: plain(n.Value)}
+			switch {
+			case n.Path&internalPath != 0:
+				entry.Visibility = "internal"
+			case n.Path&resultPath != 0:
+				entry.Visibility = "result"
+			case n.Path == 0:
+				entry.Visibility = "public"
+			default:
+				entry.Visibility = "restricted"
+			}
+			if entry.Visibility != "internal" {
+				entry = decryptEntry(entry)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func decryptEntry(entry SnapshotEntry) SnapshotEntry {
+	value, err := decryptIfNeed(entry.Key, entry.Value)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Value = value
+	return entry
+}
+
+// plain unwraps the values wrapped by the engine, such as pointers and step results.
+func plain(value any) any {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || v.Kind() != reflect.Struct || v.Type().PkgPath() != enginePkg || v.NumField() != 1 {
+		return value
+	}
+	field := v.Type().Field(0).Name
+	if field != "Elem" && field != "Result" {
+		return value
+	}
+	inner := v.Field(0)
+	if !inner.CanInterface() {
+		return value
+	}
+	return plain(inner.Interface())
+}
+
+func sortEntries(entries []SnapshotEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Path < entries[j].Path
+	})
+}
+
+func scopeOrder(scope string) int {
+	switch scope {
+	case "flow":
+		return 0
+	case "process":
+		return 1
+	case "step":
+		return 2
+	}
+	return 3
+}
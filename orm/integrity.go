@@ -0,0 +1,133 @@
+package orm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const defaultVerifyBatch = 500
+
+var (
+	ErrCheckpointCorrupted = errors.New("checkpoint is corrupted")
+)
+
+// CorruptionError names the checkpoint whose snapshot does not match its digest.
+type CorruptionError struct {
+	CheckpointId string `json:"checkpoint_id"`
+	RecoverId    string `json:"recover_id"`
+	RootUid      string `json:"root_uid"`
+	Name         string `json:"name"`
+	Scope        uint8  `json:"scope"`
+	// Unsigned is set if the checkpoint has no digest while snapshots are signed.
+	Unsigned bool `json:"unsigned,omitempty"`
+}
+
+func (e *CorruptionError) Error() string {
+	problem := "does not match its digest"
+	if e.Unsigned {
+		problem = "has no digest"
+	}
+	return fmt.Sprintf("%s: Checkpoint[Name: %s, Id: %s, RecoverId: %s, RootUid: %s] %s",
+		ErrCheckpointCorrupted.Error(), e.Name, e.CheckpointId, e.RecoverId, e.RootUid, problem)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCheckpointCorrupted
+}
+
+// SignWith digests snapshots with HMAC-SHA256 of key instead of SHA-256,
+// so that a tampered snapshot can not be given a matching digest without the key.
+// Checkpoints without digest are corrupted once snapshots are signed, unless AllowUnsignedLegacy is set.
+func (s *suspendPlugin[C, R, PC, PR]) SignWith(key []byte) SuspendPlugin {
+	s.signKey = key
+	return s
+}
+
+// AllowUnsignedLegacy recovers the checkpoints saved before digests were introduced although snapshots are signed.
+// Anyone who can rewrite a snapshot can also clear its digest, so only set it until the legacy checkpoints are consumed.
+func (s *suspendPlugin[C, R, PC, PR]) AllowUnsignedLegacy() SuspendPlugin {
+	s.allowUnsigned = true
+	return s
+}
+
+// VerifyCheckpoints scans all checkpoints, batch rows at a time, and returns the ones that do not match their digest.
+// If snapshots are signed, the checkpoints without digest are returned with Unsigned set even if AllowUnsignedLegacy is set.
+func (s *suspendPlugin[C, R, PC, PR]) VerifyCheckpoints(batch int) ([]*CorruptionError, error) {
+	if batch <= 0 {
+		batch = defaultVerifyBatch
+	}
+	corrupted := make([]*CorruptionError, 0)
+	last := ""
+	for {
+		query := s.Where("id > ?", last)
+		if len(s.tenantId) != 0 {
+			query = query.Where("tenant_id = ?", s.tenantId)
+		}
+		var checkpoints []PC
+		if err := query.Order("id").Limit(batch).Find(&checkpoints).Error; err != nil {
+			return corrupted, err
+		}
+		for _, cp := range checkpoints {
+			model := cp.checkpointModel()
+			if err := s.verify(model); err != nil {
+				corrupted = append(corrupted, err)
+			} else if len(model.Digest) == 0 && len(s.signKey) != 0 {
+				corrupted = append(corrupted, s.unsigned(model))
+			}
+		}
+		if len(checkpoints) < batch {
+			return corrupted, nil
+		}
+		last = checkpoints[len(checkpoints)-1].GetId()
+	}
+}
+
+// digest covers checkpoint id as well, so that snapshots swapped between rows are detected.
+func (s *suspendPlugin[C, R, PC, PR]) digest(id string, snapshot []byte) string {
+	var sum []byte
+	if len(s.signKey) != 0 {
+		mac := hmac.New(sha256.New, s.signKey)
+		mac.Write([]byte(id))
+		mac.Write(snapshot)
+		sum = mac.Sum(nil)
+	} else {
+		hash := sha256.New()
+		hash.Write([]byte(id))
+		hash.Write(snapshot)
+		sum = hash.Sum(nil)
+	}
+	return hex.EncodeToString(sum)
+}
+
+// verify skips checkpoints saved before digests were introduced, unless snapshots are signed.
+func (s *suspendPlugin[C, R, PC, PR]) verify(cp *Checkpoint) *CorruptionError {
+	if len(cp.Digest) == 0 {
+		if len(s.signKey) == 0 || s.allowUnsigned {
+			return nil
+		}
+		return s.unsigned(cp)
+	}
+	if hmac.Equal([]byte(cp.Digest), []byte(s.digest(cp.Id, cp.Snapshot))) {
+		return nil
+	}
+	return s.corruption(cp)
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) unsigned(cp *Checkpoint) *CorruptionError {
+	corrupted := s.corruption(cp)
+	corrupted.Unsigned = true
+	return corrupted
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) corruption(cp *Checkpoint) *CorruptionError {
+	return &CorruptionError{
+		CheckpointId: cp.Id,
+		RecoverId:    cp.RecoverId,
+		RootUid:      cp.RootUid,
+		Name:         cp.Name,
+		Scope:        cp.Scope,
+	}
+}
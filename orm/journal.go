@@ -0,0 +1,605 @@
+package orm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RecoverJournal marks the recover record of a running flow saved by continuous checkpointing,
+	// it turns into flow.RecoverIdle once the run is found interrupted.
+	RecoverJournal uint8 = 64
+	// journalKey keeps the values journaled for each process in the internal context of the flow snapshot,
+	// they are set to the process when it starts again, so that the values saved by the engine do not shadow them.
+	journalKey = "journal"
+)
+
+var (
+	journalOnce sync.Once
+	journalLock sync.RWMutex
+	journaler   journalWriter
+)
+
+type journalWriter interface {
+	beginJournal(wf flow.WorkFlow) error
+	restore(proc flow.Process)
+	commitStep(step flow.Step) error
+	endJournal(wf flow.WorkFlow) error
+}
+
+type continuous struct {
+	enable  bool
+	keys    []string
+	running sync.Map // root uid -> *journal
+}
+
+type journal struct {
+	sync.Mutex
+	recoverId string                    // empty if the journal failed to be saved
+	table     map[string]any            // flow context of the flow snapshot, kept as it is
+	internal  map[string]any            // internal context of the flow snapshot
+	values    map[string]map[string]any // process name -> encrypted values captured after its steps completed
+	restored  map[string]map[string]any // process name -> values to set when the process starts again
+	pending   map[string][]string       // step id -> steps that may read its result
+	done      map[string]bool
+}
+
+// ContinuousCheckpoint saves checkpoints incrementally after each step completes, so that a run interrupted by crash
+// can be resumed from the last completed step by ResumeInterrupted.
+// Only the values of keys are carried over, they must not be pointers.
+// A completed step stays in the journal until every step depending on it completes,
+// so it is executed again on resume to restore the result they read.
+// Values are encrypted with the encryptor set by SetEncryptor or SetKeyring, so set it before flows start.
+func (s *suspendPlugin[C, R, PC, PR]) ContinuousCheckpoint(keys ...string) SuspendPlugin {
+	s.continuous.enable = true
+	s.continuous.keys = append(s.continuous.keys, keys...)
+	return s
+}
+
+// ResumeInterrupted recovers the runs whose journal has not been updated for staleAfter,
+// staleAfter should be longer than the longest step lasts.
+func (s *suspendPlugin[C, R, PC, PR]) ResumeInterrupted(staleAfter time.Duration) ([]flow.FinishedWorkFlow, error) {
+	deadline := time.Now().Add(-staleAfter)
+	query := s.Where("status = ? AND updated_at < ?", RecoverJournal, deadline)
+	if len(s.tenantId) != 0 {
+		query = query.Where("tenant_id = ?", s.tenantId)
+	}
+	var records []PR
+	if err := query.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	resumed := make([]flow.FinishedWorkFlow, 0, len(records))
+	failures := make([]string, 0)
+	for _, record := range records {
+		// another instance may have resumed it
+		claimed, err := s.transit(record.GetRecoverId(), func(db *gorm.DB) *gorm.DB {
+			return db.Where("status = ? AND updated_at < ?", RecoverJournal, deadline)
+		}, map[string]interface{}{
+			"status":           flow.RecoverIdle,
+			"claimed_by":       s.worker,
+			"claimed_at":       time.Now(),
+			"lease_expires_at": time.Now().Add(s.lease),
+		})
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", record.GetRootUid(), err.Error()))
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		// the recovery interrupted with the journal is taken over by it
+		if err = s.supersede(record); err != nil {
+			logger.Errorf("Supersede recover records of Flow[Name: %s, ID: %s] failed, error: %s",
+				record.GetName(), record.GetRootUid(), err.Error())
+		}
+		ret, err := s.recoverAs(record)
+		if err != nil {
+			if err := s.unclaim(record); err != nil {
+				logger.Errorf("Release claim of RecoverRecord[RootUid: %s, RecoverId: %s] failed, error: %s",
+					record.GetRootUid(), record.GetRecoverId(), err.Error())
+			}
+			failures = append(failures, fmt.Sprintf("%s: %s", record.GetRootUid(), err.Error()))
+			continue
+		}
+		resumed = append(resumed, ret)
+	}
+	if len(failures) != 0 {
+		return resumed, fmt.Errorf("resume interrupted flows failed, %s", strings.Join(failures, "; "))
+	}
+	return resumed, nil
+}
+
+// supersede fails the running records saved before journal, they belong to the recovery interrupted with it.
+func (s *suspendPlugin[C, R, PC, PR]) supersede(journal PR) error {
+	var interrupted []string
+	err := s.Model(PR(new(R))).
+		Where("root_uid = ? AND sequence < ? AND status = ?", journal.GetRootUid(), journal.recordModel().Sequence, flow.RecoverRunning).
+		Pluck("recover_id", &interrupted).Error
+	if err != nil {
+		return err
+	}
+	for _, id := range interrupted {
+		_, err = s.transit(id, func(db *gorm.DB) *gorm.DB {
+			return db.Where("status = ?", flow.RecoverRunning)
+		}, map[string]interface{}{"status": flow.RecoverFailed})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) beginJournal(wf flow.WorkFlow) error {
+	runtime, ok := wf.(flow.FinishedWorkFlow)
+	if !ok {
+		return nil
+	}
+	j := &journal{
+		table:    make(map[string]any),
+		internal: make(map[string]any),
+		values:   make(map[string]map[string]any),
+		pending:  dependents(runtime),
+		done:     make(map[string]bool),
+	}
+	recoverId := uuid.NewString()
+	var cps []PC
+	var err error
+	if wf.Has(flow.Recovering) {
+		cps, err = s.resumeJournal(wf, j, recoverId)
+	} else {
+		cps, err = s.startJournal(wf, runtime, j, recoverId)
+	}
+	// values to restore are set to processes even if the journal fails to be saved
+	s.continuous.running.Store(wf.ID(), j)
+	if err != nil {
+		return err
+	}
+	record := s.newRecord(&RecoverRecord{
+		RootUid:   wf.ID(),
+		RecoverId: recoverId,
+		Status:    RecoverJournal,
+		Name:      wf.Name(),
+	}, s.tenancy.resolve(wf))
+	record.recordModel().define(encodeDefinition(runtime))
+	for attempt := 0; attempt < sequenceRetries; attempt++ {
+		err = s.Transaction(func(tx *gorm.DB) error {
+			if err := s.retain(tx, models(cps)...); err != nil {
+				return err
+			}
+			if err := tx.CreateInBatches(&cps, s.saveBatch).Error; err != nil {
+				return err
+			}
+			// a recovered run is journaled after the records of its suspensions
+			sequence, err := s.sequence(tx, wf.ID())
+			if err != nil {
+				return err
+			}
+			record.recordModel().Sequence = sequence
+			if err := tx.Create(record).Error; err != nil {
+				if sequenceTaken(err) {
+					return errSequenceTaken
+				}
+				return err
+			}
+			return tx.Create(s.transition(record.recordModel(), 0, RecoverJournal)).Error
+		})
+		if !errors.Is(err, errSequenceTaken) {
+			break
+		}
+	}
+	if err != nil {
+		for _, cp := range cps {
+			s.dropBlobs(cp.checkpointModel().BlobKey)
+		}
+		return err
+	}
+	j.Lock()
+	j.recoverId = recoverId
+	j.Unlock()
+	// journals left by an interrupted run are superseded once the run is recovered otherwise
+	var stale []string
+	if err = s.Model(PR(new(R))).
+		Where("root_uid = ? AND status = ? AND recover_id <> ?", wf.ID(), RecoverJournal, recoverId).
+		Pluck("recover_id", &stale).Error; err != nil {
+		return err
+	}
+	for _, id := range stale {
+		if err = s.dropJournal(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startJournal journals every process and step of a new run, the flow context holds the values of keys when it starts.
+func (s *suspendPlugin[C, R, PC, PR]) startJournal(wf flow.WorkFlow, runtime flow.FinishedWorkFlow, j *journal, recoverId string) ([]PC, error) {
+	ctx := make(map[string]any)
+	for _, key := range s.continuous.keys {
+		if value, exist := wf.Get(key); exist {
+			ctx[key] = value
+		}
+	}
+	var err error
+	if j.table, err = encryptValues(ctx); err != nil {
+		return nil, err
+	}
+	flowSnap, err := j.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	// processes restore nothing from their snapshot, journaled values are set when they start
+	procSnap, err := serialize(map[string][]struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	checkpoints := []flow.CheckPoint{&Checkpoint{
+		Id:        uuid.NewString(),
+		Uid:       wf.ID(),
+		Name:      wf.Name(),
+		RecoverId: recoverId,
+		RootUid:   wf.ID(),
+		Scope:     flow.FlowScope,
+		Snapshot:  flowSnap,
+	}}
+	for _, proc := range runtime.Processes() {
+		checkpoints = append(checkpoints, &Checkpoint{
+			Id:        uuid.NewString(),
+			Uid:       proc.ID(),
+			Name:      proc.Name(),
+			RecoverId: recoverId,
+			ParentUid: wf.ID(),
+			RootUid:   wf.ID(),
+			Scope:     flow.ProcessScope,
+			Snapshot:  procSnap,
+		})
+		// steps are removed from journal once they are committed
+		for _, step := range proc.Steps() {
+			checkpoints = append(checkpoints, &Checkpoint{
+				Id:        uuid.NewString(),
+				Uid:       step.ID(),
+				Name:      step.Name(),
+				RecoverId: recoverId,
+				ParentUid: proc.ID(),
+				RootUid:   wf.ID(),
+				Scope:     flow.StepScope,
+			})
+		}
+	}
+	tenantId := s.tenancy.resolve(wf)
+	cps := make([]PC, len(checkpoints))
+	for i, cp := range checkpoints {
+		if cps[i], err = s.newCheckpoint(cp, tenantId); err != nil {
+			return nil, err
+		}
+	}
+	return cps, nil
+}
+
+// resumeJournal journals a recovered run from the checkpoints of the record being recovered,
+// the values journaled before are restored if the record is a journal itself.
+func (s *suspendPlugin[C, R, PC, PR]) resumeJournal(wf flow.WorkFlow, j *journal, recoverId string) ([]PC, error) {
+	origin := PR(new(R))
+	err := s.Where("root_uid = ? AND status = ? AND claimed_by = ?", wf.ID(), flow.RecoverRunning, s.worker).
+		Order("sequence DESC").
+		First(origin).Error
+	if err != nil {
+		return nil, fmt.Errorf("record being recovered is not found: %w", err)
+	}
+	var journaled int64
+	if err = s.Model(&RecoverRecordTransition{}).
+		Where("recover_id = ? AND to_status = ?", origin.GetRecoverId(), RecoverJournal).
+		Count(&journaled).Error; err != nil {
+		return nil, err
+	}
+	var checkpoints []PC
+	if err = s.Where("recover_id = ?", origin.GetRecoverId()).Find(&checkpoints).Error; err != nil {
+		return nil, err
+	}
+	cps := make([]PC, len(checkpoints))
+	for i, cp := range checkpoints {
+		model := cp.checkpointModel()
+		if err = s.open(model); err != nil {
+			return nil, err
+		}
+		snapshot := model.Snapshot
+		if model.Scope == flow.FlowScope {
+			if err = j.load(snapshot, journaled != 0); err != nil {
+				return nil, err
+			}
+			if snapshot, err = j.snapshot(); err != nil {
+				return nil, err
+			}
+		}
+		clone := PC(new(C))
+		*clone = *cp
+		copied := clone.checkpointModel()
+		copied.Id = uuid.NewString()
+		copied.RecoverId = recoverId
+		copied.Version = 0
+		copied.CreatedAt, copied.UpdatedAt = time.Now(), time.Now()
+		if err = s.store(copied, snapshot); err != nil {
+			return nil, err
+		}
+		cps[i] = clone
+	}
+	return cps, nil
+}
+
+// restore sets the values journaled for proc before it was interrupted.
+func (s *suspendPlugin[C, R, PC, PR]) restore(proc flow.Process) {
+	value, ok := s.continuous.running.Load(proc.FlowID())
+	if !ok {
+		return
+	}
+	j := value.(*journal)
+	j.Lock()
+	defer j.Unlock()
+	for k, v := range j.restored[proc.Name()] {
+		proc.Set(k, v)
+	}
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) commitStep(step flow.Step) error {
+	value, ok := s.continuous.running.Load(step.FlowID())
+	if !ok {
+		return nil
+	}
+	j := value.(*journal)
+	j.Lock()
+	defer j.Unlock()
+	if len(j.recoverId) == 0 {
+		return nil
+	}
+	ctx := make(map[string]any)
+	for _, key := range s.continuous.keys {
+		if v, exist := step.Get(key); exist {
+			ctx[key] = v
+		}
+	}
+	values, err := encryptValues(ctx)
+	if err != nil {
+		return err
+	}
+	if previous, exist := j.values[step.ProcessName()]; exist {
+		for k, v := range values {
+			previous[k] = v
+		}
+	} else {
+		j.values[step.ProcessName()] = values
+	}
+	snapshot, err := j.snapshot()
+	if err != nil {
+		return err
+	}
+	committed := j.commit(step.ID())
+	var replaced []string
+	err = s.Transaction(func(tx *gorm.DB) error {
+		if len(committed) != 0 {
+			if err = tx.Where("recover_id = ? AND scope = ? AND uid IN ?", j.recoverId, flow.StepScope, committed).
+				Delete(PC(new(C))).Error; err != nil {
+				return err
+			}
+		}
+		var flows []PC
+		if err = tx.Select("id", "blob_key", "snapshot_hash").
+			Where("recover_id = ? AND scope = ?", j.recoverId, flow.FlowScope).
+			Find(&flows).Error; err != nil {
+			return err
+		}
+		for _, cp := range flows {
+			updates, err := s.stored(tx, cp.GetId(), snapshot)
+			if err != nil {
+				return err
+			}
+			if err = s.release(tx, cp.checkpointModel().SnapshotHash); err != nil {
+				return err
+			}
+			updates["updated_at"] = time.Now()
+			if err = tx.Model(PC(new(C))).Where("id = ?", cp.GetId()).Updates(updates).Error; err != nil {
+				return err
+			}
+			if previous := cp.checkpointModel().BlobKey; previous != updates["blob_key"] {
+				replaced = append(replaced, previous)
+			}
+		}
+		return tx.Model(PR(new(R))).
+			Where("recover_id = ?", j.recoverId).
+			Update("updated_at", time.Now()).Error
+	})
+	if err != nil {
+		// the steps are committed again with the next step
+		for _, id := range committed {
+			j.pending[id] = nil
+		}
+		return err
+	}
+	s.dropBlobs(replaced...)
+	return nil
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) endJournal(wf flow.WorkFlow) error {
+	value, ok := s.continuous.running.LoadAndDelete(wf.ID())
+	if !ok {
+		return nil
+	}
+	j := value.(*journal)
+	j.Lock()
+	recoverId := j.recoverId
+	j.Unlock()
+	if len(recoverId) == 0 {
+		return nil
+	}
+	return s.dropJournal(recoverId)
+}
+
+// dropJournal removes the journal of recoverId with its checkpoints.
+func (s *suspendPlugin[C, R, PC, PR]) dropJournal(recoverId string) error {
+	blobKeys, hashes, err := s.references(s.Where("recover_id = ?", recoverId))
+	if err != nil {
+		return err
+	}
+	err = s.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("recover_id = ?", recoverId).Delete(PC(new(C))).Error; err != nil {
+			return err
+		}
+		if err := s.release(tx, hashes...); err != nil {
+			return err
+		}
+		return tx.Where("recover_id = ?", recoverId).Delete(PR(new(R))).Error
+	})
+	if err == nil {
+		s.dropBlobs(blobKeys...)
+	}
+	return err
+}
+
+// load takes the flow context of snapshot, and the journaled values if restore is set.
+func (j *journal) load(snapshot []byte, restore bool) error {
+	maps, err := deserialize[[]map[string]any](snapshot)
+	if err != nil {
+		return err
+	}
+	j.table, j.internal = maps[0], maps[1]
+	values, _ := j.internal[journalKey].(map[string]map[string]any)
+	if !restore || values == nil {
+		return nil
+	}
+	j.values = values
+	j.restored = make(map[string]map[string]any, len(values))
+	for name, ctx := range values {
+		plain := make(map[string]any, len(ctx))
+		for k, v := range ctx {
+			if plain[k], err = decryptIfNeed(k, v); err != nil {
+				return err
+			}
+		}
+		j.restored[name] = plain
+	}
+	return nil
+}
+
+// snapshot encodes the flow snapshot with the journaled values.
+func (j *journal) snapshot() ([]byte, error) {
+	internal := make(map[string]any, len(j.internal)+1)
+	for k, v := range j.internal {
+		internal[k] = v
+	}
+	internal[journalKey] = j.values
+	return serialize([]map[string]any{j.table, internal})
+}
+
+// commit marks step done, and returns the completed steps whose results are no longer read by pending steps.
+func (j *journal) commit(step string) []string {
+	j.done[step] = true
+	committed := make([]string, 0)
+	for id, waiters := range j.pending {
+		if !j.done[id] {
+			continue
+		}
+		finished := true
+		for _, waiter := range waiters {
+			finished = finished && j.done[waiter]
+		}
+		if finished {
+			committed = append(committed, id)
+			delete(j.pending, id)
+		}
+	}
+	return committed
+}
+
+// dependents maps every step to the steps that depend on it directly or indirectly,
+// since a step reads the results of all the steps it depends on.
+func dependents(runtime flow.FinishedWorkFlow) map[string][]string {
+	pending := make(map[string][]string)
+	for _, proc := range runtime.Processes() {
+		ids := make(map[string]string)
+		for _, step := range proc.Steps() {
+			ids[step.Name()] = step.ID()
+		}
+		waiters := make(map[string][]string)
+		for _, step := range proc.Steps() {
+			for _, name := range step.Dependents() {
+				waiters[ids[name]] = append(waiters[ids[name]], step.ID())
+			}
+		}
+		for _, step := range proc.Steps() {
+			visited := make(map[string]bool)
+			queue := append([]string{}, waiters[step.ID()]...)
+			for len(queue) != 0 {
+				id := queue[0]
+				queue = queue[1:]
+				if visited[id] {
+					continue
+				}
+				visited[id] = true
+				queue = append(queue, waiters[id]...)
+			}
+			descendants := make([]string, 0, len(visited))
+			for id := range visited {
+				descendants = append(descendants, id)
+			}
+			pending[step.ID()] = descendants
+		}
+	}
+	return pending
+}
+
+func setJournaler(writer journalWriter) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	journaler = writer
+	if writer == nil {
+		return
+	}
+	// callbacks are registered once, and always write to the latest injected plugin
+	journalOnce.Do(registerJournal)
+}
+
+func currentJournaler() journalWriter {
+	journalLock.RLock()
+	defer journalLock.RUnlock()
+	return journaler
+}
+
+func registerJournal() {
+	flow.DefaultCallback().BeforeFlow(false, func(wf flow.WorkFlow) (keepOn bool, err error) {
+		if writer := currentJournaler(); writer != nil {
+			if err = writer.beginJournal(wf); err != nil {
+				logger.Errorf("Begin journal of Flow[Name: %s, ID: %s] failed, error: %s", wf.Name(), wf.ID(), err.Error())
+			}
+		}
+		return true, nil
+	})
+	flow.DefaultCallback().BeforeProcess(false, func(proc flow.Process) (keepOn bool, err error) {
+		if writer := currentJournaler(); writer != nil {
+			writer.restore(proc)
+		}
+		return true, nil
+	})
+	flow.DefaultCallback().AfterStep(false, func(step flow.Step) (keepOn bool, err error) {
+		if !step.Success() {
+			return true, nil
+		}
+		if writer := currentJournaler(); writer != nil {
+			if err = writer.commitStep(step); err != nil {
+				logger.Errorf("Commit journal of Step[Name: %s, ID: %s] failed, error: %s", step.Name(), step.ID(), err.Error())
+			}
+		}
+		return true, nil
+	})
+	flow.DefaultCallback().AfterFlow(false, func(wf flow.WorkFlow) (keepOn bool, err error) {
+		if writer := currentJournaler(); writer != nil {
+			if err = writer.endJournal(wf); err != nil {
+				logger.Errorf("End journal of Flow[Name: %s, ID: %s] failed, error: %s", wf.Name(), wf.ID(), err.Error())
+			}
+		}
+		return true, nil
+	})
+}
@@ -0,0 +1,227 @@
+package orm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/gorm"
+)
+
+const defaultRotateBatch = 100
+
+// plainKey is the key id of the checkpoints saved while encryption is disabled,
+// they are encrypted with the current key instead of being decrypted once encryption is enabled.
+const plainKey = "-"
+
+var (
+	ErrUnknownKey = errors.New("encryption key is not in keyring")
+	errSkipped    = errors.New("checkpoint has been rewritten")
+)
+
+// Keyring holds the key that encrypts snapshots and the retired keys that only decrypt them,
+// each checkpoint records the id of the key that encrypted it.
+type Keyring struct {
+	current string
+	keys    map[string]flow.SymmetricEncryptor
+}
+
+// NewKeyring creates a keyring whose current key is encryptor identified by id.
+func NewKeyring(id string, encryptor flow.SymmetricEncryptor) *Keyring {
+	return &Keyring{current: id, keys: map[string]flow.SymmetricEncryptor{id: encryptor}}
+}
+
+// Retired adds a key that decrypts the checkpoints encrypted before rotation.
+// Checkpoints saved before key ids were recorded have the empty id, retire the encryptor used then as "",
+// or nil if encryption was disabled then.
+func (k *Keyring) Retired(id string, encryptor flow.SymmetricEncryptor) *Keyring {
+	if id != k.current {
+		k.keys[id] = encryptor
+	}
+	return k
+}
+
+// SetKeyring sets the current key of keyring as the encryptor of the engine,
+// checkpoints encrypted by retired keys are re-encrypted with it before the engine loads them.
+// Use it instead of flow.SetEncryptor, and call it before flows start since the engine reads its encryptor without lock.
+// Keys retired after SetKeyring are ignored.
+func SetKeyring(k *Keyring) {
+	keys := make(map[string]flow.SymmetricEncryptor, len(k.keys))
+	for id, encryptor := range k.keys {
+		keys[id] = encryptor
+	}
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	flow.SetEncryptor(keys[k.current])
+	keyring = &Keyring{current: k.current, keys: keys}
+}
+
+// currentKeyring returns nil if encryption is disabled.
+func currentKeyring() *Keyring {
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+	return keyring
+}
+
+// RotateKeys re-encrypts the checkpoints encrypted by retired keys with the current key, batch rows at a time.
+// It returns the number of checkpoints re-encrypted.
+func (s *suspendPlugin[C, R, PC, PR]) RotateKeys(batch int) (int64, error) {
+	if currentKeyring() == nil {
+		return 0, nil
+	}
+	current := currentKeyId()
+	if batch <= 0 {
+		batch = defaultRotateBatch
+	}
+	var total int64
+	last := ""
+	for {
+		query := s.Where("id > ? AND key_id <> ?", last, current)
+		if len(s.tenantId) != 0 {
+			query = query.Where("tenant_id = ?", s.tenantId)
+		}
+		var checkpoints []PC
+		if err := query.Order("id").Limit(batch).Find(&checkpoints).Error; err != nil {
+			return total, err
+		}
+		for _, cp := range checkpoints {
+			model := cp.checkpointModel()
+			previous, blobKey, hash := model.KeyId, model.BlobKey, model.SnapshotHash
+			if err := s.open(model); err != nil {
+				return total, err
+			}
+			replaced := false
+			err := s.Transaction(func(tx *gorm.DB) error {
+				updates, err := s.stored(tx, model.Id, model.Snapshot)
+				if err != nil {
+					return err
+				}
+				// the row is skipped if it has been rotated or rewritten meanwhile
+				result := tx.Model(PC(new(C))).
+					Where("id = ? AND key_id = ?", model.Id, previous).
+					Updates(updates)
+				if result.Error != nil || result.RowsAffected == 0 {
+					// the reference retained for the skipped update is rolled back as well
+					if result.Error == nil {
+						result.Error = errSkipped
+					}
+					return result.Error
+				}
+				replaced = updates["blob_key"] != blobKey
+				return s.release(tx, hash)
+			})
+			if errors.Is(err, errSkipped) {
+				continue
+			}
+			if err != nil {
+				return total, err
+			}
+			if replaced {
+				s.dropBlobs(blobKey)
+			}
+			total++
+		}
+		if len(checkpoints) < batch {
+			return total, nil
+		}
+		last = checkpoints[len(checkpoints)-1].GetId()
+	}
+}
+
+// currentKeyId is the key id saved with new checkpoints, the key set by SetEncryptor has the empty id.
+func currentKeyId() string {
+	if k := currentKeyring(); k != nil {
+		return k.current
+	}
+	return plainKey
+}
+
+// rekey re-encrypts the loaded snapshot of cp with the current key in place.
+func (s *suspendPlugin[C, R, PC, PR]) rekey(cp *Checkpoint) error {
+	k := currentKeyring()
+	if k == nil || cp.KeyId == k.current {
+		return nil
+	}
+	var from flow.SymmetricEncryptor
+	if cp.KeyId != plainKey {
+		exist := false
+		if from, exist = k.keys[cp.KeyId]; !exist {
+			return fmt.Errorf("%w: key %q of Checkpoint[Name: %s, Id: %s]", ErrUnknownKey, cp.KeyId, cp.Name, cp.Id)
+		}
+	}
+	if len(cp.Snapshot) != 0 {
+		var snapshot []byte
+		var err error
+		switch cp.Scope {
+		case flow.FlowScope:
+			snapshot, err = rekeyFlow(cp.Snapshot, from, k.keys[k.current])
+		case flow.ProcessScope:
+			snapshot, err = rekeyProc(cp.Snapshot, from, k.keys[k.current])
+		default:
+			snapshot = cp.Snapshot
+		}
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt Checkpoint[Name: %s, Id: %s]: %w", cp.Name, cp.Id, err)
+		}
+		cp.Snapshot = snapshot
+	}
+	cp.KeyId = k.current
+	return nil
+}
+
+func rekeyFlow(snapshot []byte, from, to flow.SymmetricEncryptor) ([]byte, error) {
+	maps, err := deserialize[[]map[string]any](snapshot)
+	if err != nil {
+		return nil, err
+	}
+	table := maps[0]
+	for k, v := range table {
+		if table[k], err = rekeyValue(k, v, from, to); err != nil {
+			return nil, err
+		}
+	}
+	// values journaled by continuous checkpointing are encrypted as the flow context is
+	if values, ok := maps[1][journalKey].(map[string]map[string]any); ok {
+		for _, ctx := range values {
+			for k, v := range ctx {
+				if ctx[k], err = rekeyValue(k, v, from, to); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return serialize(maps)
+}
+
+// rekeyProc re-encrypts every node as the engine encrypts and decrypts them by key regardless of path.
+func rekeyProc(snapshot []byte, from, to flow.SymmetricEncryptor) ([]byte, error) {
+	nodes, err := deserialize[map[string][]node](snapshot)
+	if err != nil {
+		return nil, err
+	}
+	for k, list := range nodes {
+		for i := range list {
+			if list[i].Value, err = rekeyValue(k, list[i].Value, from, to); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return serialize(nodes)
+}
+
+// rekeyValue decrypts value with from unless it is nil, and encrypts it with to.
+func rekeyValue(key string, value any, from, to flow.SymmetricEncryptor) (any, error) {
+	text, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+	var err error
+	if from != nil && from.NeedEncrypt(key) {
+		if text, err = from.Decrypt(text, from.GetSecret()); err != nil {
+			return nil, err
+		}
+	}
+	if to.NeedEncrypt(key) {
+		return to.Encrypt(text, to.GetSecret())
+	}
+	return text, nil
+}
@@ -0,0 +1,111 @@
+package orm
+
+import (
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+type FlowLabel struct {
+	Id        uint   `gorm:"primaryKey;autoIncrement"`
+	FlowId    string `gorm:"type:char(36);uniqueIndex:idx_flow_label"`
+	Name      string `gorm:"type:varchar(64);uniqueIndex:idx_flow_label;index:idx_label_value"`
+	Value     string `gorm:"type:varchar(255);index:idx_label_value"`
+	CreatedAt *time.Time
+	UpdatedAt *time.Time
+}
+
+// LabelFromContext labels every run with the values of the given context keys, keys absent from context are skipped.
+func (p *persistence[F, P, S, PF, PP, PS]) LabelFromContext(keys ...string) PersistenceOf[PF] {
+	p.labelKeys = append(p.labelKeys, keys...)
+	return p
+}
+
+// LabelBy labels every run with the key/value pairs returned by labeler.
+func (p *persistence[F, P, S, PF, PP, PS]) LabelBy(labeler func(wf flow.WorkFlow) map[string]string) PersistenceOf[PF] {
+	p.labelers = append(p.labelers, labeler)
+	return p
+}
+
+// ListFlows lists runs ordered by creation time, each filter is formatted as label=value and all of them must match.
+func (p *persistence[F, P, S, PF, PP, PS]) ListFlows(filters ...string) ([]PF, error) {
+	query, err := p.tenancy.scope(p.Model(PF(new(F))), p.tenantId, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, filter := range filters {
+		parts := strings.SplitN(filter, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("invalid label filter: %s", filter)
+		}
+		labeled := p.Model(&FlowLabel{}).
+			Select("flow_id").
+			Where("name = ? AND value = ?", strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		query = query.Where("id IN (?)", labeled)
+	}
+	var flows []PF
+	if err := query.Order("created_at DESC").Find(&flows).Error; err != nil {
+		return nil, err
+	}
+	return flows, nil
+}
+
+func (p *persistence[F, P, S, PF, PP, PS]) ListLabels(flowId string) (map[string]string, error) {
+	query := p.Where("flow_id = ?", flowId)
+	if len(p.tenantId) != 0 || p.tenancy.enabled() {
+		owned, err := p.tenancy.scope(p.Model(PF(new(F))).Select("id"), p.tenantId, "")
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("flow_id IN (?)", owned)
+	}
+	var labels []*FlowLabel
+	if err := query.Find(&labels).Error; err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(labels))
+	for _, label := range labels {
+		m[label.Name] = label.Value
+	}
+	return m, nil
+}
+
+func (p *persistence[F, P, S, PF, PP, PS]) collectLabels(wf flow.WorkFlow) map[string]string {
+	labels := make(map[string]string)
+	for _, key := range p.labelKeys {
+		if value, exist := wf.Get(key); exist && value != nil {
+			labels[key] = fmt.Sprint(value)
+		}
+	}
+	for _, labeler := range p.labelers {
+		for k, v := range labeler(wf) {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+func (p *persistence[F, P, S, PF, PP, PS]) saveLabels(tx *gorm.DB, wf flow.WorkFlow) error {
+	labels := p.collectLabels(wf)
+	if len(labels) == 0 {
+		return nil
+	}
+	now := time.Now()
+	rows := make([]*FlowLabel, 0, len(labels))
+	for k, v := range labels {
+		rows = append(rows, &FlowLabel{
+			FlowId:    wf.ID(),
+			Name:      k,
+			Value:     v,
+			CreatedAt: &now,
+			UpdatedAt: &now,
+		})
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "flow_id"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&rows).Error
+}
@@ -1,6 +1,7 @@
-package light_flow_plugins
+package orm
 
 import (
+	"github.com/Bilibotter/light-flow/flow"
 	"log"
 	"os"
 )
@@ -13,21 +14,19 @@ var (
 	logger LoggerI = newDefaultLogger()
 )
 
-type LoggerI interface {
-	Debug(v ...interface{})
-	Info(v ...interface{})
-	Warn(v ...interface{})
-	Error(v ...interface{})
-	Debugf(format string, v ...interface{})
-	Infof(format string, v ...interface{})
-	Warnf(format string, v ...interface{})
-	Errorf(format string, v ...interface{})
-}
+// LoggerI is the logger of the engine, the plugins report the failures of background work with it too.
+type LoggerI = flow.LoggerI
 
 type defaultLogger struct {
 	*log.Logger
 }
 
+// SetLogger sets the logger of both the engine and the plugins.
+func SetLogger(l LoggerI) {
+	flow.SetLogger(l)
+	logger = l
+}
+
 func newDefaultLogger() *defaultLogger {
 	return &defaultLogger{
 		Logger: log.New(os.Stdout, "[light-flow] ", log.LstdFlags),
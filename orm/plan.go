@@ -0,0 +1,372 @@
+package orm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ErrUnsupportedEngine is returned when the engine no longer saves what a plan is read from.
+var ErrUnsupportedEngine = errors.New("unsupported engine version")
+
+// break points kept by the engine in internal context, a break point that does not skip run
+// means a must before callback failed, so the whole scope is executed again.
+const (
+	flowBreakPoint = "|||%s"
+	procBreakPoint = "||%s"
+)
+
+// FlowDefinition is the structure of a flow captured when it is suspended.
+type FlowDefinition struct {
+	Name      string              `json:"name"`
+	Processes []ProcessDefinition `json:"processes"`
+}
+
+type ProcessDefinition struct {
+	Name  string           `json:"name"`
+	Steps []StepDefinition `json:"steps"`
+}
+
+type StepDefinition struct {
+	Name    string   `json:"name"`
+	Depends []string `json:"depends,omitempty"`
+}
+
+// RecoveryPlan explains what recovering a record will execute, without executing it.
+type RecoveryPlan struct {
+	RecoverId string `json:"recover_id"`
+	RootUid   string `json:"root_uid"`
+	Name      string `json:"name"`
+	Status    uint8  `json:"status"`
+	// Scopes are the scopes that have checkpoints.
+	Scopes []string `json:"scopes"`
+	// RerunAll is set if a before callback of flow failed, so every process is executed again.
+	RerunAll bool `json:"rerun_all"`
+	// FlowKeys are the keys of flow context restored.
+	FlowKeys  []string       `json:"flow_keys"`
+	Processes []*ProcessPlan `json:"processes"`
+	// Defined is false for the records saved before definitions were captured,
+	// steps are then only known from checkpoints, and dependents of re-run steps are not listed.
+	Defined bool `json:"defined"`
+}
+
+type ProcessPlan struct {
+	Name string `json:"name"`
+	// Recovering is false if the process completed, it is skipped entirely.
+	Recovering bool `json:"recovering"`
+	// RerunAll is set if a before callback of process failed, so all its steps are executed again.
+	RerunAll  bool     `json:"rerun_all"`
+	Rerun     []string `json:"rerun"`
+	Completed []string `json:"completed"`
+	// Keys are the keys of process context restored, including step results.
+	Keys []string `json:"keys"`
+}
+
+// PlanRecovery reports which steps recovering id will execute again and which context it restores, id is a recover id
+// or a root uid whose latest record is planned. The plan follows the rules that the engine loads checkpoints with.
+func (s *suspendPlugin[C, R, PC, PR]) PlanRecovery(id string) (*RecoveryPlan, error) {
+	recoverId, err := s.resolveRecoverId(id)
+	if err != nil {
+		return nil, err
+	}
+	query, err := s.tenancy.scope(s.DB, s.tenantId, recoverId)
+	if err != nil {
+		return nil, err
+	}
+	record := PR(new(R))
+	if err = query.Where("recover_id = ?", recoverId).First(record).Error; err != nil {
+		return nil, err
+	}
+	checkpoints, err := s.ListCheckpoints(recoverId)
+	if err != nil {
+		return nil, err
+	}
+	rcd := record.recordModel()
+	plan := &RecoveryPlan{
+		RecoverId: rcd.RecoverId,
+		RootUid:   rcd.RootUid,
+		Name:      rcd.Name,
+		Status:    rcd.Status,
+		Scopes:    make([]string, 0),
+		FlowKeys:  make([]string, 0),
+		Processes: make([]*ProcessPlan, 0),
+	}
+	definition := &FlowDefinition{Name: rcd.Name}
+	if len(rcd.Definition) != 0 {
+		if err = json.Unmarshal([]byte(rcd.Definition), definition); err != nil {
+			return nil, err
+		}
+		plan.Defined = true
+	}
+	if err = plan.build(definition, checkpoints); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (p *RecoveryPlan) build(definition *FlowDefinition, checkpoints []flow.CheckPoint) error {
+	procs := make(map[string]*ProcessPlan)
+	depends := make(map[string]map[string][]string) // process -> step -> depends
+	for _, proc := range definition.Processes {
+		procs[proc.Name] = &ProcessPlan{Name: proc.Name, Keys: make([]string, 0)}
+		depends[proc.Name] = make(map[string][]string)
+		for _, step := range proc.Steps {
+			depends[proc.Name][step.Name] = step.Depends
+		}
+	}
+	scopes := make(map[uint8]bool)
+	id2Name := make(map[string]string)
+	for _, cp := range checkpoints {
+		scopes[cp.GetScope()] = true
+		switch cp.GetScope() {
+		case flow.FlowScope:
+			keys, rerun, err := planFlow(cp.GetSnapshot(), definition.Name)
+			if err != nil {
+				return fmt.Errorf("failed to decode Checkpoint[Name: %s, Id: %s]: %w", cp.GetName(), cp.GetId(), err)
+			}
+			p.FlowKeys, p.RerunAll = keys, rerun
+		case flow.ProcessScope:
+			proc, exist := procs[cp.GetName()]
+			if !exist {
+				proc = &ProcessPlan{Name: cp.GetName()}
+				procs[cp.GetName()] = proc
+			}
+			keys, rerun, err := planProc(cp.GetSnapshot(), cp.GetName())
+			if err != nil {
+				return fmt.Errorf("failed to decode Checkpoint[Name: %s, Id: %s]: %w", cp.GetName(), cp.GetId(), err)
+			}
+			proc.Recovering, proc.RerunAll, proc.Keys = true, rerun, keys
+			id2Name[cp.GetUid()] = cp.GetName()
+		}
+	}
+	rerun := make(map[string]map[string]bool)
+	for name, proc := range procs {
+		rerun[name] = make(map[string]bool)
+		if p.RerunAll || proc.RerunAll {
+			for step := range depends[name] {
+				rerun[name][step] = true
+			}
+		}
+	}
+	waiters := make(map[string]map[string][]string)
+	for name, steps := range depends {
+		waiters[name] = make(map[string][]string)
+		for step, deps := range steps {
+			for _, dep := range deps {
+				waiters[name][dep] = append(waiters[name][dep], step)
+			}
+		}
+	}
+	for _, cp := range checkpoints {
+		if cp.GetScope() != flow.StepScope {
+			continue
+		}
+		name, exist := id2Name[cp.GetParentUid()]
+		if !exist {
+			return fmt.Errorf("the process for [Step: %s] is not define", cp.GetName())
+		}
+		// steps depending on a re-run step are executed again as well
+		markRerun(rerun[name], waiters[name], cp.GetName())
+	}
+	for name, proc := range procs {
+		if p.RerunAll {
+			proc.Recovering = true
+		}
+		proc.Rerun, proc.Completed = make([]string, 0), make([]string, 0)
+		for step := range rerun[name] {
+			proc.Rerun = append(proc.Rerun, step)
+		}
+		for step := range depends[name] {
+			if !rerun[name][step] {
+				proc.Completed = append(proc.Completed, step)
+			}
+		}
+		sort.Strings(proc.Rerun)
+		sort.Strings(proc.Completed)
+		p.Processes = append(p.Processes, proc)
+	}
+	sort.Slice(p.Processes, func(i, j int) bool {
+		return p.Processes[i].Name < p.Processes[j].Name
+	})
+	for _, scope := range []uint8{flow.FlowScope, flow.ProcessScope, flow.StepScope} {
+		if scopes[scope] {
+			p.Scopes = append(p.Scopes, scopeName(scope))
+		}
+	}
+	return nil
+}
+
+// String renders the plan as human-readable text.
+func (p *RecoveryPlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Recovery plan of %s [RootUid: %s, RecoverId: %s]\n", p.Name, p.RootUid, p.RecoverId)
+	fmt.Fprintf(&b, "checkpoints: %s\n", listed(p.Scopes))
+	if p.RerunAll {
+		b.WriteString("before callback of flow failed, every process executes again\n")
+	}
+	fmt.Fprintf(&b, "flow context: %s\n", listed(p.FlowKeys))
+	for _, proc := range p.Processes {
+		if !proc.Recovering {
+			fmt.Fprintf(&b, "process %s: completed, skipped\n", proc.Name)
+			continue
+		}
+		fmt.Fprintf(&b, "process %s: recovering\n", proc.Name)
+		if proc.RerunAll {
+			b.WriteString("  before callback of process failed, every step executes again\n")
+		}
+		fmt.Fprintf(&b, "  re-run:    %s\n", listed(proc.Rerun))
+		fmt.Fprintf(&b, "  completed: %s\n", listed(proc.Completed))
+		fmt.Fprintf(&b, "  context:   %s\n", listed(proc.Keys))
+	}
+	if !p.Defined {
+		b.WriteString("definition was not captured, completed steps and dependents of re-run steps are unknown\n")
+	}
+	return b.String()
+}
+
+// defineFlow captures the structure of wf, sorted so that equal structures encode equally.
+func defineFlow(wf flow.FinishedWorkFlow) *FlowDefinition {
+	definition := &FlowDefinition{Name: wf.Name(), Processes: make([]ProcessDefinition, 0)}
+	for _, proc := range wf.Processes() {
+		process := ProcessDefinition{Name: proc.Name(), Steps: make([]StepDefinition, 0)}
+		for _, step := range proc.Steps() {
+			process.Steps = append(process.Steps, StepDefinition{Name: step.Name(), Depends: step.Dependents()})
+		}
+		definition.Processes = append(definition.Processes, process)
+	}
+	return definition.sorted()
+}
+
+func (d *FlowDefinition) sorted() *FlowDefinition {
+	for _, process := range d.Processes {
+		for _, step := range process.Steps {
+			sort.Strings(step.Depends)
+		}
+		sort.Slice(process.Steps, func(i, j int) bool {
+			return process.Steps[i].Name < process.Steps[j].Name
+		})
+	}
+	sort.Slice(d.Processes, func(i, j int) bool {
+		return d.Processes[i].Name < d.Processes[j].Name
+	})
+	return d
+}
+
+// definitionOf encodes the definition of the flow among checkpoints, it is empty if there is none.
+func definitionOf(checkpoints []flow.CheckPoint) string {
+	for _, cp := range checkpoints {
+		if wf, ok := cp.(flow.FinishedWorkFlow); ok && cp.GetScope() == flow.FlowScope {
+			return encodeDefinition(wf)
+		}
+	}
+	return ""
+}
+
+func encodeDefinition(wf flow.FinishedWorkFlow) string {
+	data, err := json.Marshal(defineFlow(wf))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func markRerun(rerun map[string]bool, waiters map[string][]string, step string) {
+	if rerun[step] {
+		return
+	}
+	rerun[step] = true
+	for _, waiter := range waiters[step] {
+		markRerun(rerun, waiters, waiter)
+	}
+}
+
+func planFlow(snapshot []byte, name string) ([]string, bool, error) {
+	keys := make([]string, 0)
+	if len(snapshot) == 0 {
+		return keys, false, nil
+	}
+	maps, err := deserialize[[]map[string]any](snapshot)
+	if err != nil {
+		return nil, false, err
+	}
+	for key := range maps[0] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(maps) < 2 {
+		return keys, false, nil
+	}
+	rerun, err := rerunAll(maps[1][fmt.Sprintf(flowBreakPoint, name)])
+	if err != nil {
+		return nil, false, err
+	}
+	return keys, rerun, nil
+}
+
+func planProc(snapshot []byte, name string) ([]string, bool, error) {
+	keys := make([]string, 0)
+	if len(snapshot) == 0 {
+		return keys, false, nil
+	}
+	nodes, err := deserialize[map[string][]node](snapshot)
+	if err != nil {
+		return nil, false, err
+	}
+	rerun := false
+	for key, list := range nodes {
+		restored := false
+		for _, n := range list {
+			if n.Path&internalPath == 0 {
+				restored = true
+			} else if key == fmt.Sprintf(procBreakPoint, name) {
+				if rerun, err = rerunAll(n.Value); err != nil {
+					return nil, false, err
+				}
+			}
+		}
+		if restored {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, rerun, nil
+}
+
+// rerunAll reads the break point of engine, whose type is not exported.
+// The engine saves it as a pointer, so it is wrapped in the pointerValue of engine.
+// A break point without SkipRun fails the plan instead of mispredicting it.
+func rerunAll(point any) (bool, error) {
+	if point == nil {
+		return false, nil
+	}
+	v := reflect.Indirect(reflect.ValueOf(plain(point)))
+	if v.IsValid() && v.Kind() == reflect.Struct {
+		if skipRun := v.FieldByName("SkipRun"); skipRun.IsValid() && skipRun.Kind() == reflect.Bool {
+			return !skipRun.Bool(), nil
+		}
+	}
+	return false, fmt.Errorf("%w: break point %T has no SkipRun", ErrUnsupportedEngine, plain(point))
+}
+
+func scopeName(scope uint8) string {
+	switch scope {
+	case flow.FlowScope:
+		return "flow"
+	case flow.ProcessScope:
+		return "process"
+	case flow.StepScope:
+		return "step"
+	}
+	return fmt.Sprintf("unknown(%d)", scope)
+}
+
+func listed(items []string) string {
+	if len(items) == 0 {
+		return "-"
+	}
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,285 @@
+package orm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/gorm"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RecoverDead marks the recover record whose root has failed to recover for max attempts,
+	// it is no longer recovered automatically.
+	RecoverDead uint8 = 128
+)
+
+const recoverBatch = 100
+
+type recovery struct {
+	sync.Mutex
+	interval    time.Duration
+	maxAttempts int
+	base        time.Duration
+	max         time.Duration
+	limits      map[string]int
+	slots       map[string]chan struct{}
+	stop        chan struct{}
+	start       sync.Once
+	once        sync.Once
+}
+
+type attemptCount struct {
+	RootUid  string
+	Attempts int
+}
+
+func newRecovery() *recovery {
+	return &recovery{
+		maxAttempts: 3,
+		base:        time.Minute,
+		max:         time.Hour,
+		limits:      make(map[string]int),
+		slots:       make(map[string]chan struct{}),
+		stop:        make(chan struct{}),
+	}
+}
+
+// AutoRecover polls idle recover records every interval and recovers them in background.
+func (s *suspendPlugin[C, R, PC, PR]) AutoRecover(interval time.Duration) SuspendPlugin {
+	s.recovery.interval = interval
+	return s
+}
+
+// MaxAttempts moves the recover record to RecoverDead once its root has failed to recover n times, 0 means unlimited.
+func (s *suspendPlugin[C, R, PC, PR]) MaxAttempts(n int) SuspendPlugin {
+	s.recovery.maxAttempts = n
+	return s
+}
+
+// RecoverBackoff delays the next attempt of a root for base doubled by each failed attempt, up to max.
+func (s *suspendPlugin[C, R, PC, PR]) RecoverBackoff(base, max time.Duration) SuspendPlugin {
+	s.recovery.base = base
+	s.recovery.max = max
+	return s
+}
+
+// RecoverConcurrency limits the number of flows named name recovering at the same time on this instance.
+func (s *suspendPlugin[C, R, PC, PR]) RecoverConcurrency(name string, limit int) SuspendPlugin {
+	s.recovery.Lock()
+	defer s.recovery.Unlock()
+	s.recovery.limits[name] = limit
+	delete(s.recovery.slots, name)
+	return s
+}
+
+// Close stops automatic recovery and rejection, recoveries already started are not interrupted.
+func (s *suspendPlugin[C, R, PC, PR]) Close() {
+	s.recovery.once.Do(func() {
+		close(s.recovery.stop)
+	})
+}
+
+// RecoverOnce claims the idle recover records that are due and recovers them, it returns after all recoveries finish.
+func (s *suspendPlugin[C, R, PC, PR]) RecoverOnce() ([]flow.FinishedWorkFlow, error) {
+	var lock sync.Mutex
+	recovered := make([]flow.FinishedWorkFlow, 0)
+	failures := make([]string, 0)
+	wg, err := s.dispatch(func(record PR, ret flow.FinishedWorkFlow, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", record.GetRootUid(), err.Error()))
+			return
+		}
+		recovered = append(recovered, ret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	wg.Wait()
+	if len(failures) != 0 {
+		return recovered, fmt.Errorf("recover flows failed, %s", strings.Join(failures, "; "))
+	}
+	return recovered, nil
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) dispatch(done func(record PR, ret flow.FinishedWorkFlow, err error)) (*sync.WaitGroup, error) {
+	wg := &sync.WaitGroup{}
+	now := time.Now()
+	query := s.Where("(status = ? AND (claimed_by IS NULL OR claimed_by = '' OR lease_expires_at < ?)) OR (status = ? AND lease_expires_at < ?)",
+		flow.RecoverIdle, now, flow.RecoverRunning, now)
+	if len(s.tenantId) != 0 {
+		query = query.Where("tenant_id = ?", s.tenantId)
+	}
+	var records []PR
+	if err := query.Order("created_at").Limit(recoverBatch).Find(&records).Error; err != nil {
+		return wg, err
+	}
+	if len(records) == 0 {
+		return wg, nil
+	}
+	attempts, err := s.countAttempts(records)
+	if err != nil {
+		return wg, err
+	}
+	for _, record := range records {
+		rcd := record.recordModel()
+		if rcd.Status == flow.RecoverIdle && s.expiry.expired(rcd) {
+			if _, err = s.expire(record); err != nil {
+				return wg, err
+			}
+			continue
+		}
+		attempt := attempts[rcd.RootUid]
+		if s.recovery.maxAttempts > 0 && attempt >= s.recovery.maxAttempts {
+			if err = s.deadLetter(record); err != nil {
+				return wg, err
+			}
+			continue
+		}
+		ready := rcd.CreatedAt
+		if rcd.ClaimedAt != nil && rcd.ClaimedAt.After(ready) {
+			ready = *rcd.ClaimedAt
+		}
+		if now.Before(ready.Add(s.recovery.backoff(attempt))) {
+			continue
+		}
+		release, ok := s.recovery.acquire(rcd.Name)
+		if !ok {
+			continue
+		}
+		if err := s.claim(unscoped, record.GetRecoverId(), false, nil); err != nil {
+			release()
+			if errors.Is(err, ErrAlreadyClaimed) {
+				continue
+			}
+			return wg, err
+		}
+		wg.Add(1)
+		go func(record PR) {
+			defer wg.Done()
+			defer release()
+			ret, err := s.recoverAs(record)
+			if err != nil {
+				// the record stays idle only if recovery failed before re-execution, let it be claimed again after backoff,
+				// unclaim leaves it alone once re-execution has moved it out of idle
+				if err := s.unclaim(record); err != nil {
+					logger.Errorf("Release claim of RecoverRecord[RootUid: %s, RecoverId: %s] failed, error: %s",
+						record.GetRootUid(), record.GetRecoverId(), err.Error())
+				}
+			}
+			done(record, ret, err)
+		}(record)
+	}
+	return wg, nil
+}
+
+// countAttempts counts failed recoveries of each root, every failed recovery leaves a RecoverFailed record.
+func (s *suspendPlugin[C, R, PC, PR]) countAttempts(records []PR) (map[string]int, error) {
+	roots := make([]string, len(records))
+	for i, record := range records {
+		roots[i] = record.GetRootUid()
+	}
+	var counts []attemptCount
+	err := s.Model(PR(new(R))).
+		Select("root_uid, COUNT(*) AS attempts").
+		Where("root_uid IN ? AND status = ?", roots, flow.RecoverFailed).
+		Group("root_uid").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	attempts := make(map[string]int, len(counts))
+	for _, count := range counts {
+		attempts[count.RootUid] = count.Attempts
+	}
+	return attempts, nil
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) deadLetter(record PR) error {
+	moved, err := s.transit(record.GetRecoverId(), func(db *gorm.DB) *gorm.DB {
+		return db.Where("status = ?", flow.RecoverIdle).
+			Where("claimed_by IS NULL OR claimed_by = '' OR lease_expires_at < ?", time.Now())
+	}, map[string]interface{}{"status": RecoverDead})
+	if err != nil {
+		return err
+	}
+	if moved {
+		logger.Warnf("RecoverRecord[Name: %s, RootUid: %s, RecoverId: %s] exhausted max attempts, moved to dead letter",
+			record.GetName(), record.GetRootUid(), record.GetRecoverId())
+	}
+	return nil
+}
+
+// recoverAs recovers the root of record within the tenant of record.
+func (s *suspendPlugin[C, R, PC, PR]) recoverAs(record PR) (flow.FinishedWorkFlow, error) {
+	var plugin SuspendPlugin = s
+	if tenantId := record.recordModel().TenantId; len(tenantId) != 0 {
+		plugin = s.Tenant(tenantId)
+	}
+	return plugin.Recover(record.GetRootUid())
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) autoRecover() {
+	if s.recovery.interval <= 0 {
+		return
+	}
+	s.recovery.start.Do(func() {
+		go s.poll()
+	})
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) poll() {
+	ticker := time.NewTicker(s.recovery.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.recovery.stop:
+			return
+		case <-ticker.C:
+			_, err := s.dispatch(func(record PR, _ flow.FinishedWorkFlow, err error) {
+				if err != nil {
+					logger.Errorf("Recover Flow[Name: %s, ID: %s] failed, error: %s", record.GetName(), record.GetRootUid(), err.Error())
+				}
+			})
+			if err != nil {
+				logger.Errorf("Poll recover records failed, error: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (r *recovery) backoff(attempt int) time.Duration {
+	delay := r.base
+	for i := 0; i < attempt && delay < r.max; i++ {
+		delay *= 2
+	}
+	if delay > r.max {
+		return r.max
+	}
+	return delay
+}
+
+func (r *recovery) acquire(name string) (release func(), ok bool) {
+	r.Lock()
+	limit, limited := r.limits[name]
+	if !limited {
+		r.Unlock()
+		return func() {}, true
+	}
+	slot, exist := r.slots[name]
+	if !exist {
+		slot = make(chan struct{}, limit)
+		r.slots[name] = slot
+	}
+	r.Unlock()
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,164 @@
+package orm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+var (
+	ErrNotRewindable = errors.New("recover record can not be rewound")
+)
+
+// RewindOp is recorded in checkpoint_audits for a rewind, its key is process and step joined by "/".
+const RewindOp EditOp = "rewind"
+
+// rewindable records are not being executed, finished ones are turned back to idle.
+var rewindable = []uint8{flow.RecoverIdle, flow.RecoverSuccess, flow.RecoverFailed, RecoverDead, RecoverExpired}
+
+// RewindStep makes the next recovery execute step of process and the steps depending on it again,
+// even if they succeeded. id is a recover id or a root uid whose latest record is rewound, a finished record turns idle.
+// The context restored by the process checkpoint is kept, so the process must have been checkpointed.
+func (s *suspendPlugin[C, R, PC, PR]) RewindStep(id, process, step, operator, reason string) error {
+	recoverId, err := s.resolveRecoverId(id)
+	if err != nil {
+		return err
+	}
+	scope, err := s.tenancy.scoped(s.tenantId, recoverId)
+	if err != nil {
+		return err
+	}
+	changes, err := json.Marshal([]ContextEdit{{Op: RewindOp, Key: process + "/" + step}})
+	if err != nil {
+		return err
+	}
+	return s.Transaction(func(tx *gorm.DB) error {
+		record := PR(new(R))
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Scopes(scope).
+			Where("recover_id = ?", recoverId).
+			First(record).Error
+		if err != nil {
+			return err
+		}
+		rcd := record.recordModel()
+		allowed := false
+		for _, status := range rewindable {
+			allowed = allowed || status == rcd.Status
+		}
+		if !allowed {
+			return fmt.Errorf("%w: recover record %s is executing", ErrNotRewindable, recoverId)
+		}
+		var later int64
+		err = tx.Model(PR(new(R))).
+			Where("root_uid = ? AND sequence > ?", rcd.RootUid, rcd.Sequence).
+			Count(&later).Error
+		if err != nil {
+			return err
+		}
+		if later != 0 {
+			return fmt.Errorf("%w: recover record %s is not the latest of root %s", ErrNotRewindable, recoverId, rcd.RootUid)
+		}
+		if err = checkDefined(rcd.Definition, process, step); err != nil {
+			return err
+		}
+		var checkpoints []PC
+		err = tx.Where("recover_id = ? AND scope IN ?", recoverId, []uint8{flow.FlowScope, flow.ProcessScope}).
+			Find(&checkpoints).Error
+		if err != nil {
+			return err
+		}
+		var parent *Checkpoint
+		restorable := false
+		for _, cp := range checkpoints {
+			model := cp.checkpointModel()
+			switch {
+			case model.Scope == flow.FlowScope:
+				restorable = len(model.Snapshot) != 0
+			case model.Name == process:
+				parent = model
+			}
+		}
+		if !restorable {
+			return fmt.Errorf("%w: checkpoints of recover record %s have been collected", ErrNotRewindable, recoverId)
+		}
+		if parent == nil {
+			return fmt.Errorf("%w: context of [Process: %s] was not checkpointed", ErrNotRewindable, process)
+		}
+		target := PC(new(C))
+		err = tx.Where("recover_id = ? AND parent_uid = ? AND scope = ? AND name = ?", recoverId, parent.Uid, flow.StepScope, step).
+			Limit(1).
+			Find(target).Error
+		if err != nil {
+			return err
+		}
+		model := target.checkpointModel()
+		if len(model.Id) == 0 {
+			// a step checkpoint without snapshot executes the step from scratch, as journal does
+			if target, err = s.newCheckpoint(&Checkpoint{
+				Id:        uuid.NewString(),
+				Uid:       uuid.NewString(),
+				Name:      step,
+				RecoverId: recoverId,
+				ParentUid: parent.Uid,
+				RootUid:   rcd.RootUid,
+				Scope:     flow.StepScope,
+			}, rcd.TenantId); err != nil {
+				return err
+			}
+			if err = tx.Create(target).Error; err != nil {
+				return err
+			}
+			model = target.checkpointModel()
+		}
+		if rcd.Status != flow.RecoverIdle {
+			err = tx.Model(PR(new(R))).
+				Where("recover_id = ?", recoverId).
+				Updates(map[string]interface{}{"status": flow.RecoverIdle, "claimed_by": "", "lease_expires_at": nil}).Error
+			if err != nil {
+				return err
+			}
+			if err = tx.Create(s.transition(rcd, rcd.Status, flow.RecoverIdle)).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&CheckpointAudit{
+			CheckpointId: model.Id,
+			RecoverId:    recoverId,
+			RootUid:      rcd.RootUid,
+			Version:      model.Version,
+			Operator:     operator,
+			Reason:       reason,
+			Changes:      string(changes),
+			TenantId:     rcd.TenantId,
+			CreatedAt:    time.Now(),
+		}).Error
+	})
+}
+
+// checkDefined skips the records saved before definitions were captured, the engine reports unknown steps on recovery.
+func checkDefined(encoded, process, step string) error {
+	if len(encoded) == 0 {
+		return nil
+	}
+	definition := &FlowDefinition{}
+	if err := json.Unmarshal([]byte(encoded), definition); err != nil {
+		return err
+	}
+	for _, proc := range definition.Processes {
+		if proc.Name != process {
+			continue
+		}
+		for _, defined := range proc.Steps {
+			if defined.Name == step {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: [Step: %s] not belong to [Process: %s]", ErrNotRewindable, step, process)
+}
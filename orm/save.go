@@ -12,18 +12,62 @@ const (
 	Suspend
 	Success
 	Failure
+	Abandoned
 )
 
 const (
 	dbHasCreate = "already exists"
 )
 
-type Persistence interface {
+// Persistence persists runs with the built-in models.
+type Persistence = PersistenceOf[*Flow]
+
+// PersistenceOf persists runs with the flow model PF, reads return PF so that custom fields are filled.
+type PersistenceOf[PF any] interface {
 	InjectPersistence() error
+	LabelFromContext(keys ...string) PersistenceOf[PF]
+	LabelBy(labeler func(wf flow.WorkFlow) map[string]string) PersistenceOf[PF]
+	ListFlows(filters ...string) ([]PF, error)
+	ListLabels(flowId string) (map[string]string, error)
+	WithTenant(resolver TenantResolver) PersistenceOf[PF]
+	Tenant(tenantId string) PersistenceOf[PF]
+	WithWorker(worker Worker) PersistenceOf[PF]
+	Heartbeat(interval time.Duration) PersistenceOf[PF]
+	Reaper(timeout, interval time.Duration) PersistenceOf[PF]
+	OnAbandon(hook func(abandoned PF) error) PersistenceOf[PF]
+	Reap(timeout time.Duration) ([]PF, error)
+	Close()
+}
+
+// FlowRecord is satisfied by any struct embedding Flow.
+type FlowRecord[F any] interface {
+	*F
+	flowRecord() *Flow
+}
+
+// ProcRecord is satisfied by any struct embedding Process.
+type ProcRecord[P any] interface {
+	*P
+	procRecord() *Process
+}
+
+// StepRecord is satisfied by any struct embedding Step.
+type StepRecord[S any] interface {
+	*S
+	stepRecord() *Step
 }
 
-type persistence struct {
+type persistence[F, P, S any, PF FlowRecord[F], PP ProcRecord[P], PS StepRecord[S]] struct {
 	*gorm.DB
+	labelKeys []string
+	labelers  []func(wf flow.WorkFlow) map[string]string
+	mapFlow   func(wf flow.WorkFlow, record PF)
+	mapProc   func(proc flow.Process, record PP)
+	mapStep   func(step flow.Step, record PS)
+	tenancy   *tenancy
+	tenantId  string
+	worker    string
+	keeper    *keeper[PF]
 }
 
 type Step struct {
@@ -32,6 +76,8 @@ type Step struct {
 	Status     int8
 	ProcId     string `gorm:"type:char(36)"`
 	FlowId     string `gorm:"type:char(36)"`
+	TenantId   string `gorm:"type:varchar(64);index"`
+	Worker     string `gorm:"type:varchar(255)"`
 	CreatedAt  *time.Time
 	UpdatedAt  *time.Time
 	FinishedAt *time.Time
@@ -42,153 +88,266 @@ type Process struct {
 	Name       string
 	Status     int8
 	FlowId     string `gorm:"type:char(36)"`
+	TenantId   string `gorm:"type:varchar(64);index"`
 	CreatedAt  *time.Time
 	UpdatedAt  *time.Time
 	FinishedAt *time.Time
 }
 
 type Flow struct {
-	Id         string `gorm:"primaryKey;type:char(36)"`
-	Name       string
-	Status     int8
-	CreatedAt  *time.Time
-	UpdatedAt  *time.Time
-	FinishedAt *time.Time
+	Id            string `gorm:"primaryKey;type:char(36)"`
+	Name          string
+	Status        int8
+	TenantId      string `gorm:"type:varchar(64);index"`
+	Worker        string `gorm:"type:varchar(255)"`
+	LastHeartbeat *time.Time
+	CreatedAt     *time.Time
+	UpdatedAt     *time.Time
+	FinishedAt    *time.Time
 }
 
-func NewPersistPlugin(db *gorm.DB) Persistence {
-	p := &persistence{db}
+func (s *Step) stepRecord() *Step {
+	return s
+}
+
+func (p *Process) procRecord() *Process {
 	return p
 }
 
-func (p *persistence) CreateTables() error {
-	if tables, err := p.Migrator().GetTables(); err == nil && len(tables) >= 3 {
-		m := make(map[string]bool, len(tables))
-		for _, t := range tables {
-			m[t] = true
-		}
-		if m["flows"] && m["processes"] && m["steps"] {
-			return nil
-		}
+func (f *Flow) flowRecord() *Flow {
+	return f
+}
+
+func NewPersistPlugin(db *gorm.DB) Persistence {
+	return NewPersistPluginFor[Flow, Process, Step](db, nil, nil, nil)
+}
+
+// NewPersistPluginFor persists runs with user-defined models, each model must embed Flow, Process or Step respectively.
+// Built-in fields are filled before the mapping function is called, so the mapping function only needs to fill custom fields.
+// A nil mapping function leaves custom fields untouched.
+func NewPersistPluginFor[F, P, S any, PF FlowRecord[F], PP ProcRecord[P], PS StepRecord[S]](db *gorm.DB,
+	mapFlow func(wf flow.WorkFlow, record PF),
+	mapProc func(proc flow.Process, record PP),
+	mapStep func(step flow.Step, record PS)) PersistenceOf[PF] {
+	p := &persistence[F, P, S, PF, PP, PS]{
+		DB:      db,
+		mapFlow: mapFlow,
+		mapProc: mapProc,
+		mapStep: mapStep,
+		tenancy: newTenancy(),
+		worker:  LocalWorker().String(),
+		keeper:  &keeper[PF]{stop: make(chan struct{})},
 	}
-	if err := p.Migrator().CreateTable(&Flow{}); err != nil {
-		// can't use errors.Is(xxx, err), so use strings.Contains instead
-		if !strings.Contains(err.Error(), dbHasCreate) {
-			return err
-		}
+	if p.mapFlow == nil {
+		p.mapFlow = func(flow.WorkFlow, PF) {}
 	}
-	if err := p.Migrator().CreateTable(&Process{}); err != nil {
-		if !strings.Contains(err.Error(), dbHasCreate) {
-			return err
-		}
+	if p.mapProc == nil {
+		p.mapProc = func(flow.Process, PP) {}
+	}
+	if p.mapStep == nil {
+		p.mapStep = func(flow.Step, PS) {}
 	}
-	if err := p.Migrator().CreateTable(&Step{}); err != nil {
-		if !strings.Contains(err.Error(), dbHasCreate) {
+	return p
+}
+
+func (p *persistence[F, P, S, PF, PP, PS]) CreateTables() error {
+	for _, model := range []interface{}{PF(new(F)), PP(new(P)), PS(new(S)), &FlowLabel{}} {
+		if err := createOrMigrate(p.DB, model); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (p *persistence) InjectPersistence() error {
+// WithTenant stamps the tenant resolved from context on every flow, process and step,
+// reads must be scoped by Tenant(tenantId) afterwards.
+func (p *persistence[F, P, S, PF, PP, PS]) WithTenant(resolver TenantResolver) PersistenceOf[PF] {
+	p.tenancy.resolver = resolver
+	return p
+}
+
+// WithWorker records worker as the executor of flows and steps instead of LocalWorker.
+func (p *persistence[F, P, S, PF, PP, PS]) WithWorker(worker Worker) PersistenceOf[PF] {
+	p.worker = worker.String()
+	return p
+}
+
+// Tenant returns a view whose reads only see the runs of tenantId.
+func (p *persistence[F, P, S, PF, PP, PS]) Tenant(tenantId string) PersistenceOf[PF] {
+	scoped := *p
+	scoped.tenantId = tenantId
+	return &scoped
+}
+
+func (p *persistence[F, P, S, PF, PP, PS]) InjectPersistence() error {
 	if err := p.CreateTables(); err != nil {
 		return err
 	}
 	flow.FlowPersist().OnInsert(p.InsertFlow).OnUpdate(p.UpdateFlow)
 	flow.ProcPersist().OnInsert(p.InsertProc).OnUpdate(p.UpdateProc)
 	flow.StepPersist().OnInsert(p.InsertStep).OnUpdate(p.UpdateStep)
+	p.keepAlive()
 	return nil
 }
 
-func (p *persistence) InsertFlow(wf flow.WorkFlow) error {
-	foo := &Flow{
-		Id:        wf.ID(),
-		Name:      wf.Name(),
-		Status:    Begin,
-		CreatedAt: wf.StartTime(),
-		UpdatedAt: wf.StartTime(),
+func (p *persistence[F, P, S, PF, PP, PS]) InsertFlow(wf flow.WorkFlow) error {
+	foo := PF(new(F))
+	*foo.flowRecord() = Flow{
+		Id:            wf.ID(),
+		Name:          wf.Name(),
+		Status:        Begin,
+		TenantId:      p.tenancy.resolve(wf),
+		Worker:        p.worker,
+		LastHeartbeat: wf.StartTime(),
+		CreatedAt:     wf.StartTime(),
+		UpdatedAt:     wf.StartTime(),
 	}
-	return p.Create(foo).Error
+	p.mapFlow(wf, foo)
+	err := p.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(foo).Error; err != nil {
+			return err
+		}
+		return p.saveLabels(tx, wf)
+	})
+	if err == nil {
+		p.keeper.running.Store(wf.ID(), struct{}{})
+	}
+	return err
 }
 
-func (p *persistence) UpdateFlow(wf flow.WorkFlow) error {
+func (p *persistence[F, P, S, PF, PP, PS]) UpdateFlow(wf flow.WorkFlow) error {
+	p.keeper.running.Delete(wf.ID())
 	now := time.Now()
-	foo := &Flow{
-		UpdatedAt: &now,
-	}
+	foo := PF(new(F))
+	record := foo.flowRecord()
+	record.UpdatedAt = &now
+	// recovery may be executed by another worker
+	record.Worker = p.worker
 	if wf.Success() {
-		foo.Status = Success
+		record.Status = Success
 	} else {
-		foo.Status = Failure
+		record.Status = Failure
 	}
 	if wf.Has(flow.Suspend) {
-		foo.Status = Suspend
+		record.Status = Suspend
 	}
 	if wf.EndTime() != nil {
-		foo.FinishedAt = wf.EndTime()
+		record.FinishedAt = wf.EndTime()
 	}
-	return p.Model(&Flow{}).Where("id = ?", wf.ID()).Updates(foo).Error
+	p.mapFlow(wf, foo)
+	return p.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(PF(new(F))).Where("id = ?", wf.ID()).Updates(foo).Error; err != nil {
+			return err
+		}
+		// labels may be set to context during execution
+		return p.saveLabels(tx, wf)
+	})
 }
 
-func (p *persistence) InsertProc(proc flow.Process) error {
-	foo := &Process{
+func (p *persistence[F, P, S, PF, PP, PS]) InsertProc(proc flow.Process) error {
+	foo := PP(new(P))
+	*foo.procRecord() = Process{
 		Id:        proc.ID(),
 		Name:      proc.Name(),
 		Status:    Begin,
 		FlowId:    proc.FlowID(),
+		TenantId:  p.tenancy.resolve(proc),
 		CreatedAt: proc.StartTime(),
 		UpdatedAt: proc.StartTime(),
 	}
+	p.mapProc(proc, foo)
 	return p.Create(foo).Error
 }
 
-func (p *persistence) UpdateProc(proc flow.Process) error {
+func (p *persistence[F, P, S, PF, PP, PS]) UpdateProc(proc flow.Process) error {
 	now := time.Now()
-	foo := &Process{
-		UpdatedAt: &now,
-	}
+	foo := PP(new(P))
+	record := foo.procRecord()
+	record.UpdatedAt = &now
 	if proc.Success() {
-		foo.Status = Success
+		record.Status = Success
 	} else {
-		foo.Status = Failure
+		record.Status = Failure
 	}
 	if proc.Has(flow.Suspend) {
-		foo.Status = Suspend
+		record.Status = Suspend
 	}
 	if proc.EndTime() != nil {
-		foo.FinishedAt = proc.EndTime()
+		record.FinishedAt = proc.EndTime()
 	}
-	return p.Model(&Process{}).Where("id = ?", proc.ID()).Updates(foo).Error
+	p.mapProc(proc, foo)
+	return p.Model(PP(new(P))).Where("id = ?", proc.ID()).Updates(foo).Error
 }
 
-func (p *persistence) InsertStep(step flow.Step) error {
-	foo := &Step{
+func (p *persistence[F, P, S, PF, PP, PS]) InsertStep(step flow.Step) error {
+	foo := PS(new(S))
+	*foo.stepRecord() = Step{
 		Id:        step.ID(),
 		Name:      step.Name(),
 		Status:    Begin,
 		ProcId:    step.ProcessID(),
 		FlowId:    step.FlowID(),
+		TenantId:  p.tenancy.resolve(step),
+		Worker:    p.worker,
 		CreatedAt: step.StartTime(),
 		UpdatedAt: step.StartTime(),
 	}
+	p.mapStep(step, foo)
 	return p.Create(foo).Error
 }
 
-func (p *persistence) UpdateStep(step flow.Step) error {
+func (p *persistence[F, P, S, PF, PP, PS]) UpdateStep(step flow.Step) error {
 	now := time.Now()
-	foo := &Step{
-		UpdatedAt: &now,
-	}
+	foo := PS(new(S))
+	record := foo.stepRecord()
+	record.UpdatedAt = &now
+	record.Worker = p.worker
 	if step.Success() {
-		foo.Status = Success
+		record.Status = Success
 	} else {
-		foo.Status = Failure
+		record.Status = Failure
 	}
 	if step.Has(flow.Suspend) {
-		foo.Status = Suspend
+		record.Status = Suspend
 	}
 	if step.EndTime() != nil {
-		foo.FinishedAt = step.EndTime()
+		record.FinishedAt = step.EndTime()
+	}
+	p.mapStep(step, foo)
+	return p.Model(PS(new(S))).Where("id = ?", step.ID()).Updates(foo).Error
+}
+
+// createOrMigrate creates the table of model, or adds the columns and indexes missing from an existing table.
+func createOrMigrate(db *gorm.DB, model interface{}) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(model) {
+		if err := migrator.CreateTable(model); err != nil {
+			// can't use errors.Is(xxx, err), so use strings.Contains instead
+			if !strings.Contains(err.Error(), dbHasCreate) {
+				return err
+			}
+		}
+		return nil
+	}
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	for _, field := range stmt.Schema.Fields {
+		if len(field.DBName) == 0 || migrator.HasColumn(model, field.DBName) {
+			continue
+		}
+		if err := migrator.AddColumn(model, field.DBName); err != nil {
+			return err
+		}
+	}
+	for _, index := range stmt.Schema.ParseIndexes() {
+		if migrator.HasIndex(model, index.Name) {
+			continue
+		}
+		if err := migrator.CreateIndex(model, index.Name); err != nil {
+			return err
+		}
 	}
-	return p.Model(&Step{}).Where("id = ?", step.ID()).Updates(foo).Error
+	return nil
 }
@@ -0,0 +1,477 @@
+package orm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RecoverWaiting marks the recover record of a flow suspended by WaitForSignal,
+	// it is not recovered automatically but by Signal.
+	RecoverWaiting uint8 = 160
+)
+
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+	ApprovalTimedOut = "timeout"
+)
+
+var (
+	ErrWaitingForSignal = errors.New("step is waiting for signal")
+	ErrNotWaiting       = errors.New("recover record is not waiting for signal")
+	// ErrForbidden is returned by the operator extractor of SignalHandler to answer 403 instead of 401.
+	ErrForbidden = errors.New("operator is not allowed to decide approvals")
+)
+
+// waitPrefix keys the signal that a step waits for in the context of its process,
+// so that the wait is saved with the process checkpoint and taken by whichever instance saves the suspension.
+const waitPrefix = "~wait~"
+
+type wait struct {
+	Signal  string        `json:"signal"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+type rejection struct {
+	interval time.Duration
+	start    sync.Once
+}
+
+// Approval is a signal that a step of a suspended flow waits for.
+type Approval struct {
+	Id        uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	RecoverId string     `gorm:"type:varchar(64);index" json:"recover_id"`
+	RootUid   string     `gorm:"type:varchar(64);index" json:"root_uid"`
+	Name      string     `gorm:"type:varchar(255)" json:"name"`
+	Process   string     `gorm:"type:varchar(255)" json:"process"`
+	Step      string     `gorm:"type:varchar(255)" json:"step"`
+	Signal    string     `gorm:"type:varchar(255)" json:"signal"`
+	Status    string     `gorm:"type:varchar(16);index" json:"status"`
+	Deadline  *time.Time `gorm:"type:datetime;index" json:"deadline,omitempty"`
+	DecidedBy string     `gorm:"type:varchar(255)" json:"decided_by,omitempty"`
+	Reason    string     `gorm:"type:varchar(1024)" json:"reason,omitempty"`
+	TenantId  string     `gorm:"type:varchar(64);index" json:"tenant_id,omitempty"`
+	CreatedAt time.Time  `gorm:"type:datetime" json:"created_at"`
+	UpdatedAt time.Time  `gorm:"type:datetime" json:"updated_at"`
+}
+
+// WaitForSignal returns the payload of signal once it is signaled, otherwise it fails the step with ErrWaitingForSignal
+// so that the flow is suspended until Signal. A timeout greater than 0 rejects the approval once it passes.
+// The flow must enable recover.
+//
+//	proc.CustomStep(func(ctx flow.Step) (any, error) {
+//		payload, err := plugins.WaitForSignal(ctx, "approval", 24*time.Hour)
+//		...
+//	}, "approve")
+func WaitForSignal(ctx flow.Step, signal string, timeout time.Duration) (any, error) {
+	key := waitPrefix + ctx.Name()
+	if payload, exist := ctx.Get(signal); exist {
+		// cleared, so that the step failing later for other reasons does not wait again
+		ctx.Set(key, "")
+		return payload, nil
+	}
+	data, err := json.Marshal(&wait{Signal: signal, Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	ctx.Set(key, string(data))
+	return nil, fmt.Errorf("%w: %s", ErrWaitingForSignal, signal)
+}
+
+// Signal sets payload as the value of the signals that recoverId waits for in flow context, and recovers its flow.
+// The operator is saved as the decider of the approvals and the editor of the flow checkpoint.
+func (s *suspendPlugin[C, R, PC, PR]) Signal(recoverId, operator string, payload any) (flow.FinishedWorkFlow, error) {
+	record, err := s.signal(recoverId, operator, payload)
+	if err != nil {
+		return nil, err
+	}
+	return s.recoverAs(record)
+}
+
+// SignalAsync is Signal that returns once the signal is saved, its flow is recovered in background.
+// If the recovery fails before re-execution, the record is left to automatic recovery.
+func (s *suspendPlugin[C, R, PC, PR]) SignalAsync(recoverId, operator string, payload any) error {
+	record, err := s.signal(recoverId, operator, payload)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if _, err := s.recoverAs(record); err != nil {
+			logger.Errorf("Recover Flow[Name: %s, ID: %s] failed, error: %s", record.GetName(), record.GetRootUid(), err.Error())
+			// the record stays idle only if recovery failed before re-execution, let it be claimed again
+			if err := s.unclaim(record); err != nil {
+				logger.Errorf("Release claim of RecoverRecord[RootUid: %s, RecoverId: %s] failed, error: %s",
+					record.GetRootUid(), record.GetRecoverId(), err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// signal saves payload into the flow checkpoint of recoverId, and claims its record to recover.
+func (s *suspendPlugin[C, R, PC, PR]) signal(recoverId, operator string, payload any) (PR, error) {
+	scope, err := s.tenancy.scoped(s.tenantId, recoverId)
+	if err != nil {
+		return nil, err
+	}
+	record := PR(new(R))
+	replaced := ""
+	err = s.Transaction(func(tx *gorm.DB) error {
+		approvals, err := s.waiting(tx, scope, recoverId, record)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		err = tx.Model(PC(new(C))).
+			Where("recover_id = ? AND scope = ?", recoverId, flow.FlowScope).
+			Pluck("id", &ids).Error
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("%w: flow checkpoint of %s has been collected", ErrNotWaiting, recoverId)
+		}
+		edits := make([]ContextEdit, len(approvals))
+		for i, approval := range approvals {
+			edits[i] = SetKey(approval.Signal, payload)
+		}
+		if err = checkEdits(edits); err != nil {
+			return err
+		}
+		changes, err := json.Marshal(edits)
+		if err != nil {
+			return err
+		}
+		replaced, err = s.edit(tx, scope, ids[0], operator, "signal", string(changes), RecoverWaiting, edits)
+		if err != nil {
+			return err
+		}
+		// claimed for the recovery of Signal, so that automatic recovery does not take it meanwhile
+		now := time.Now()
+		return s.decide(tx, record.recordModel(), flow.RecoverIdle, ApprovalApproved, operator, "", map[string]interface{}{
+			"claimed_by":       s.worker,
+			"claimed_at":       now,
+			"lease_expires_at": now.Add(s.lease),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.dropBlobs(replaced)
+	return record, nil
+}
+
+// Reject rejects the signals that recoverId waits for, its recover record turns flow.RecoverFailed and is never recovered.
+// The operator is saved as the decider of the approvals.
+func (s *suspendPlugin[C, R, PC, PR]) Reject(recoverId, operator, reason string) error {
+	return s.reject(recoverId, ApprovalRejected, operator, reason)
+}
+
+// PendingApprovals lists the signals waited for, in the order they were created.
+func (s *suspendPlugin[C, R, PC, PR]) PendingApprovals() ([]*Approval, error) {
+	query, err := s.tenancy.scope(s.DB, s.tenantId, "")
+	if err != nil {
+		return nil, err
+	}
+	approvals := make([]*Approval, 0)
+	err = query.Where("status = ?", ApprovalPending).Order("created_at, id").Find(&approvals).Error
+	return approvals, err
+}
+
+// RejectEvery rejects the signals waited for beyond their timeout every interval in background, until Close.
+func (s *suspendPlugin[C, R, PC, PR]) RejectEvery(interval time.Duration) SuspendPlugin {
+	s.rejection.interval = interval
+	return s
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) autoReject() {
+	if s.rejection.interval <= 0 {
+		return
+	}
+	s.rejection.start.Do(func() {
+		go s.rejectTimedOut()
+	})
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) rejectTimedOut() {
+	ticker := time.NewTicker(s.rejection.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.recovery.stop:
+			return
+		case <-ticker.C:
+			if _, err := s.RejectTimedOut(); err != nil {
+				logger.Errorf("Reject timed out signals failed, error: %s", err.Error())
+			}
+		}
+	}
+}
+
+// RejectTimedOut rejects the signals waited for beyond their timeout, and returns the recover ids rejected.
+// Timeouts are only enforced by calling it, schedule it or enable RejectEvery. The approvals are decided by the worker.
+// Like RecoverOnce it rejects the approvals of every tenant unless called on a view returned by Tenant.
+func (s *suspendPlugin[C, R, PC, PR]) RejectTimedOut() ([]string, error) {
+	query := s.Model(&Approval{}).Where("status = ? AND deadline < ?", ApprovalPending, time.Now())
+	if len(s.tenantId) != 0 {
+		query = query.Where("tenant_id = ?", s.tenantId)
+	}
+	var timedOut []*Approval
+	if err := query.Distinct("recover_id", "tenant_id").Find(&timedOut).Error; err != nil {
+		return nil, err
+	}
+	rejected := make([]string, 0, len(timedOut))
+	for _, approval := range timedOut {
+		// rejected within the tenant of the record, like recoverAs
+		view := s
+		if len(approval.TenantId) != 0 {
+			view = s.tenant(approval.TenantId)
+		}
+		err := view.reject(approval.RecoverId, ApprovalTimedOut, s.worker, "timed out")
+		// signaled or rejected meanwhile
+		if errors.Is(err, ErrNotWaiting) {
+			continue
+		}
+		if err != nil {
+			return rejected, err
+		}
+		rejected = append(rejected, approval.RecoverId)
+	}
+	return rejected, nil
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) reject(recoverId, status, operator, reason string) error {
+	scope, err := s.tenancy.scoped(s.tenantId, recoverId)
+	if err != nil {
+		return err
+	}
+	return s.Transaction(func(tx *gorm.DB) error {
+		record := PR(new(R))
+		if _, err := s.waiting(tx, scope, recoverId, record); err != nil {
+			return err
+		}
+		return s.decide(tx, record.recordModel(), flow.RecoverFailed, status, operator, reason, nil)
+	})
+}
+
+// waiting locks the record of recoverId into record and returns its pending approvals.
+func (s *suspendPlugin[C, R, PC, PR]) waiting(tx *gorm.DB, scope func(*gorm.DB) *gorm.DB, recoverId string, record PR) ([]*Approval, error) {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Scopes(scope).
+		Where("recover_id = ?", recoverId).
+		First(record).Error
+	if err != nil {
+		return nil, err
+	}
+	if record.GetStatus() != RecoverWaiting {
+		return nil, fmt.Errorf("%w: %s", ErrNotWaiting, recoverId)
+	}
+	var approvals []*Approval
+	err = tx.Where("recover_id = ? AND status = ?", recoverId, ApprovalPending).
+		Find(&approvals).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(approvals) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotWaiting, recoverId)
+	}
+	return approvals, nil
+}
+
+// decide moves the waiting record to to with updates, and its pending approvals to status decided by operator.
+func (s *suspendPlugin[C, R, PC, PR]) decide(tx *gorm.DB, record *RecoverRecord, to uint8, status, operator, reason string, updates map[string]interface{}) error {
+	values := map[string]interface{}{"status": to, "updated_at": time.Now()}
+	for k, v := range updates {
+		values[k] = v
+	}
+	err := tx.Model(PR(new(R))).
+		Where("recover_id = ?", record.RecoverId).
+		Updates(values).Error
+	if err != nil {
+		return err
+	}
+	if err = tx.Create(s.transition(record, RecoverWaiting, to)).Error; err != nil {
+		return err
+	}
+	return tx.Model(&Approval{}).
+		Where("recover_id = ? AND status = ?", record.RecoverId, ApprovalPending).
+		Updates(map[string]interface{}{"status": status, "decided_by": operator, "reason": reason, "updated_at": time.Now()}).Error
+}
+
+// approvals takes the signals waited for by the steps among checkpoints of record.
+func approvals(checkpoints []flow.CheckPoint, record *RecoverRecord) ([]*Approval, error) {
+	parents := make(map[string]bool)
+	for _, cp := range checkpoints {
+		if cp.GetScope() == flow.StepScope {
+			parents[cp.GetParentUid()] = true
+		}
+	}
+	waited := make(map[string]map[string]*wait)
+	for _, cp := range checkpoints {
+		if cp.GetScope() != flow.ProcessScope || !parents[cp.GetUid()] || len(cp.GetSnapshot()) == 0 {
+			continue
+		}
+		steps, err := waitsOf(cp.GetSnapshot())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signals waited in Process[Name: %s, ID: %s]: %w", cp.GetName(), cp.GetUid(), err)
+		}
+		waited[cp.GetUid()] = steps
+	}
+	var taken []*Approval
+	for _, cp := range checkpoints {
+		if cp.GetScope() != flow.StepScope {
+			continue
+		}
+		w, ok := waited[cp.GetParentUid()][cp.GetName()]
+		if !ok {
+			continue
+		}
+		approval := &Approval{
+			RecoverId: record.RecoverId,
+			RootUid:   record.RootUid,
+			Name:      record.Name,
+			Step:      cp.GetName(),
+			Signal:    w.Signal,
+			Status:    ApprovalPending,
+			TenantId:  record.TenantId,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		if step, ok := cp.(flow.FinishedStep); ok {
+			approval.Process = step.ProcessName()
+		}
+		if w.Timeout > 0 {
+			deadline := time.Now().Add(w.Timeout)
+			approval.Deadline = &deadline
+		}
+		taken = append(taken, approval)
+	}
+	return taken, nil
+}
+
+// waitsOf reads the signals waited for by step name from the snapshot of a process.
+func waitsOf(snapshot []byte) (map[string]*wait, error) {
+	nodes, err := deserialize[map[string][]node](snapshot)
+	if err != nil {
+		return nil, err
+	}
+	waits := make(map[string]*wait)
+	for key, list := range nodes {
+		if !strings.HasPrefix(key, waitPrefix) || len(list) == 0 {
+			continue
+		}
+		// the latest value comes first, it is empty once the signal is taken
+		value, err := decryptIfNeed(key, list[0].Value)
+		if err != nil {
+			return nil, err
+		}
+		text, _ := value.(string)
+		if len(text) == 0 {
+			continue
+		}
+		w := &wait{}
+		if err = json.Unmarshal([]byte(text), w); err != nil {
+			return nil, err
+		}
+		waits[strings.TrimPrefix(key, waitPrefix)] = w
+	}
+	return waits, nil
+}
+
+type signalRequest struct {
+	RecoverId string          `json:"recover_id"`
+	Payload   json.RawMessage `json:"payload"`
+	Reject    bool            `json:"reject"`
+	Reason    string          `json:"reason"`
+}
+
+const signaled = "signaled"
+
+type signalResponse struct {
+	RecoverId string `json:"recover_id"`
+	// Result is signaled or rejected.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SignalHandler serves approvals over HTTP. GET lists pending approvals,
+// POST {"recover_id": "...", "payload": ...} signals a record and responds with 202 once the signal is saved,
+// the flow is recovered in background. POST {"recover_id": "...", "reject": true, "reason": "..."} rejects it.
+// Every request is authenticated by operator, which returns the operator deciding the approvals,
+// a request is answered with 403 if it returns ErrForbidden, and with 401 if it returns any other error.
+func SignalHandler(plugin SuspendPlugin, operator func(r *http.Request) (string, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		decider, err := operator(r)
+		if err == nil && len(decider) == 0 {
+			err = errors.New("operator is required")
+		}
+		if err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, ErrForbidden) {
+				status = http.StatusForbidden
+			}
+			w.WriteHeader(status)
+			enc.Encode(&signalResponse{Error: err.Error()})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			approvals, err := plugin.PendingApprovals()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				enc.Encode(&signalResponse{Error: err.Error()})
+				return
+			}
+			enc.Encode(approvals)
+			return
+		case http.MethodPost:
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req signalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.RecoverId) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(&signalResponse{Error: "recover_id is required"})
+			return
+		}
+		resp := &signalResponse{RecoverId: req.RecoverId, Result: signaled}
+		if req.Reject {
+			resp.Result = ApprovalRejected
+			err = plugin.Reject(req.RecoverId, decider, req.Reason)
+		} else {
+			var payload any
+			if len(req.Payload) != 0 {
+				if err = json.Unmarshal(req.Payload, &payload); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					enc.Encode(&signalResponse{RecoverId: req.RecoverId, Error: err.Error()})
+					return
+				}
+			}
+			err = plugin.SignalAsync(req.RecoverId, decider, payload)
+		}
+		switch {
+		case errors.Is(err, ErrNotWaiting), errors.Is(err, gorm.ErrRecordNotFound):
+			w.WriteHeader(http.StatusConflict)
+			resp.Result, resp.Error = "", err.Error()
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+			resp.Result, resp.Error = "", err.Error()
+		case !req.Reject:
+			w.WriteHeader(http.StatusAccepted)
+		}
+		enc.Encode(resp)
+	})
+}
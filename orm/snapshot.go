@@ -0,0 +1,107 @@
+package orm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"github.com/Bilibotter/light-flow/flow"
+	"reflect"
+	"sync"
+)
+
+var (
+	keyLock sync.RWMutex
+	keyring *Keyring
+)
+
+// node mirrors the context node of the engine, gob matches struct fields by name,
+// so process snapshots saved by the engine can be read and edited with it.
+type node struct {
+	Path  uint64
+	Value any
+	Next  *node
+}
+
+// SetEncryptor sets the encryptor of the engine, it is a keyring with a single key whose id is empty.
+// The plugins only know the encryptor set through them, so use it instead of flow.SetEncryptor.
+func SetEncryptor(encryptor flow.SymmetricEncryptor) {
+	SetKeyring(NewKeyring("", encryptor))
+}
+
+func DisableEncrypt() {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	flow.DisableEncrypt()
+	keyring = nil
+}
+
+func serialize[T any](value T) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	enc := gob.NewEncoder(writer)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func deserialize[T any](data []byte) (result T, err error) {
+	reader, err := gzip.NewReader(bytes.NewBuffer(data))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	err = gob.NewDecoder(reader).Decode(&result)
+	return
+}
+
+// encryptValues encrypts the values of ctx as the engine does, pointers are rejected
+// since the engine turns them back into pointers with a type of its own.
+func encryptValues(ctx map[string]any) (map[string]any, error) {
+	encrypted := make(map[string]any, len(ctx))
+	for k, v := range ctx {
+		if v != nil && reflect.TypeOf(v).Kind() == reflect.Pointer {
+			return nil, fmt.Errorf("value of %s is a pointer", k)
+		}
+		value, err := encryptIfNeed(k, v)
+		if err != nil {
+			return nil, err
+		}
+		encrypted[k] = value
+	}
+	return encrypted, nil
+}
+
+// currentEncryptor returns nil if encryption is disabled.
+func currentEncryptor() flow.SymmetricEncryptor {
+	if k := currentKeyring(); k != nil {
+		return k.keys[k.current]
+	}
+	return nil
+}
+
+func encryptIfNeed(key string, value any) (any, error) {
+	encryptor := currentEncryptor()
+	if encryptor == nil || !encryptor.NeedEncrypt(key) {
+		return value, nil
+	}
+	if plainText, ok := value.(string); ok {
+		return encryptor.Encrypt(plainText, encryptor.GetSecret())
+	}
+	return value, nil
+}
+
+func decryptIfNeed(key string, value any) (any, error) {
+	encryptor := currentEncryptor()
+	if encryptor == nil || !encryptor.NeedEncrypt(key) {
+		return value, nil
+	}
+	if cipherText, ok := value.(string); ok {
+		return encryptor.Decrypt(cipherText, encryptor.GetSecret())
+	}
+	return value, nil
+}
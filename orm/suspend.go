@@ -1,153 +1,499 @@
 package orm
 
 import (
+	"errors"
 	"github.com/Bilibotter/light-flow/flow"
 	"gorm.io/gorm"
-	"strings"
+	"sync"
 	"time"
 )
 
+// defaultSaveBatch keeps an insert of checkpoints well below the 65535 placeholders MySQL allows.
+const defaultSaveBatch = 500
+
 type SuspendPlugin interface {
+	flow.Persist
 	InjectSuspend() error
+	WithTenant(resolver TenantResolver) SuspendPlugin
+	Tenant(tenantId string) SuspendPlugin
+	Recover(rootUid string) (flow.FinishedWorkFlow, error)
+	WithWorker(worker Worker) SuspendPlugin
+	ContinuousCheckpoint(keys ...string) SuspendPlugin
+	ResumeInterrupted(staleAfter time.Duration) ([]flow.FinishedWorkFlow, error)
+	AutoRecover(interval time.Duration) SuspendPlugin
+	MaxAttempts(n int) SuspendPlugin
+	RecoverBackoff(base, max time.Duration) SuspendPlugin
+	RecoverConcurrency(name string, limit int) SuspendPlugin
+	RecoverOnce() ([]flow.FinishedWorkFlow, error)
+	Close()
+	ClaimLease(lease time.Duration) SuspendPlugin
+	Claim(recoverId string) error
+	Release(recoverId string) error
+	ListRecoverRecords(rootUid string) ([]*RecoverRecord, error)
+	ListTransitions(rootUid string) ([]*RecoverRecordTransition, error)
+	CollectOnSuccess(policy GCPolicy) SuspendPlugin
+	CollectGarbage(retention time.Duration, batch int) (int64, error)
+	PurgeRecords(retention time.Duration, batch int) (int64, error)
+	ExpireAfter(ttl time.Duration, names ...string) SuspendPlugin
+	OnExpire(hook func(expired *RecoverRecord) error) SuspendPlugin
+	ExpireRecords() ([]*RecoverRecord, error)
+	Inspect(id string) ([]*CheckpointView, error)
+	EditCheckpoint(checkpointId, operator, reason string, edits ...ContextEdit) error
+	ListAudits(rootUid string) ([]*CheckpointAudit, error)
+	SignWith(key []byte) SuspendPlugin
+	AllowUnsignedLegacy() SuspendPlugin
+	VerifyCheckpoints(batch int) ([]*CorruptionError, error)
+	RotateKeys(batch int) (int64, error)
+	OffloadAbove(size int, store BlobStore) SuspendPlugin
+	DeduplicateSnapshots() SuspendPlugin
+	SaveBatchSize(size int) SuspendPlugin
+	PlanRecovery(id string) (*RecoveryPlan, error)
+	RewindStep(id, process, step, operator, reason string) error
+	ForkRecovery(recoverId string, overrides ...ContextEdit) (string, error)
+	RecoverBulk(filter BulkFilter) (*BulkReport, error)
+	Signal(recoverId, operator string, payload any) (flow.FinishedWorkFlow, error)
+	SignalAsync(recoverId, operator string, payload any) error
+	Reject(recoverId, operator, reason string) error
+	PendingApprovals() ([]*Approval, error)
+	RejectTimedOut() ([]string, error)
+	RejectEvery(interval time.Duration) SuspendPlugin
+	CheckDefinitions(flows ...*flow.FlowMeta) SuspendPlugin
+	MigrateWith(hook MigrationHook) SuspendPlugin
 }
 
 type Checkpoint struct {
-	Id        string    `gorm:"column:id;primary_key"`
-	Uid       string    `gorm:"column:uid"`
-	Name      string    `gorm:"column:name;NOT NULL"`
-	RecoverId string    `gorm:"column:recover_id"`
-	ParentUid string    `gorm:"column:parent_uid"`
-	RootUid   string    `gorm:"column:root_uid"`
-	Scope     uint8     `gorm:"column:scope;NOT NULL"`
-	Snapshot  []byte    `gorm:"column:snapshot"`
-	CreatedAt time.Time `gorm:"type:datetime;column:created_at;"`
-	UpdatedAt time.Time `gorm:"type:datetime;column:updated_at;"`
+	Id           string    `gorm:"column:id;primary_key"`
+	Uid          string    `gorm:"column:uid"`
+	Name         string    `gorm:"column:name;NOT NULL"`
+	RecoverId    string    `gorm:"column:recover_id"`
+	ParentUid    string    `gorm:"column:parent_uid"`
+	RootUid      string    `gorm:"column:root_uid"`
+	Scope        uint8     `gorm:"column:scope;NOT NULL"`
+	Snapshot     []byte    `gorm:"column:snapshot"`
+	Version      uint      `gorm:"column:version;default:0"`
+	Digest       string    `gorm:"column:digest;type:varchar(64)"`
+	KeyId        string    `gorm:"column:key_id;type:varchar(64);default:''"`
+	BlobKey      string    `gorm:"column:blob_key;type:varchar(255);default:''"`
+	SnapshotHash string    `gorm:"column:snapshot_hash;type:varchar(64);index;default:''"`
+	TenantId     string    `gorm:"column:tenant_id;type:varchar(64);index"`
+	CreatedAt    time.Time `gorm:"type:datetime;column:created_at;"`
+	UpdatedAt    time.Time `gorm:"type:datetime;column:updated_at;"`
+	body         []byte    // body to save in snapshot_blobs
 }
 
 type RecoverRecord struct {
-	RootUid   string    `gorm:"column:root_uid;NOT NULL"`
-	RecoverId string    `gorm:"column:recover_id;primary_key"`
-	Status    uint8     `gorm:"column:status;NOT NULL"`
-	Name      string    `gorm:"column:name;NOT NULL"`
-	CreatedAt time.Time `gorm:"type:datetime;column:created_at;"`
-	UpdatedAt time.Time `gorm:"type:datetime;column:updated_at;"`
+	RootUid        string     `gorm:"column:root_uid;NOT NULL;uniqueIndex:idx_root_sequence"`
+	RecoverId      string     `gorm:"column:recover_id;primary_key"`
+	Status         uint8      `gorm:"column:status;NOT NULL"`
+	Name           string     `gorm:"column:name;NOT NULL"`
+	Sequence       uint       `gorm:"column:sequence;uniqueIndex:idx_root_sequence"`
+	TenantId       string     `gorm:"column:tenant_id;type:varchar(64);index"`
+	CreatedBy      string     `gorm:"column:created_by;type:varchar(255)"`
+	RecoveredBy    string     `gorm:"column:recovered_by;type:varchar(255)"`
+	ClaimedBy      string     `gorm:"column:claimed_by;type:varchar(255)"`
+	ClaimedAt      *time.Time `gorm:"column:claimed_at;type:datetime"`
+	LeaseExpiresAt *time.Time `gorm:"column:lease_expires_at;type:datetime"`
+	Definition     string     `gorm:"column:definition;type:text"`
+	Fingerprint    string     `gorm:"column:fingerprint;type:varchar(64)"`
+	ForkedFrom     string     `gorm:"column:forked_from;type:varchar(64);index"`
+	CreatedAt      time.Time  `gorm:"type:datetime;column:created_at;"`
+	UpdatedAt      time.Time  `gorm:"type:datetime;column:updated_at;"`
+}
+
+// CheckpointModel is satisfied by any struct embedding Checkpoint.
+type CheckpointModel[C any] interface {
+	*C
+	flow.CheckPoint
+	checkpointModel() *Checkpoint
 }
 
-type suspendPlugin struct {
+// RecordModel is satisfied by any struct embedding RecoverRecord.
+type RecordModel[R any] interface {
+	*R
+	flow.RecoverRecord
+	recordModel() *RecoverRecord
+}
+
+type suspendPlugin[C, R any, PC CheckpointModel[C], PR RecordModel[R]] struct {
 	*gorm.DB
+	mapCheckpoint func(cp flow.CheckPoint, model PC)
+	mapRecord     func(record flow.RecoverRecord, model PR)
+	tenancy       *tenancy
+	tenantId      string
+	worker        string
+	continuous    *continuous
+	recovery      *recovery
+	rejection     *rejection
+	lease         time.Duration
+	renewals      *sync.Map // recover id -> channel closed to stop renewing its lease
+	gcPolicy      GCPolicy
+	expiry        *expiry
+	signKey       []byte
+	allowUnsigned bool
+	offloadAbove  int
+	blobs         BlobStore
+	dedup         bool
+	saveBatch     int
+	checked       map[string]bool
+	migration     MigrationHook
 }
 
 func NewSuspendPlugin(db *gorm.DB) SuspendPlugin {
-	return &suspendPlugin{
-		DB: db,
+	return NewSuspendPluginFor[Checkpoint, RecoverRecord](db, nil, nil)
+}
+
+// NewSuspendPluginFor saves checkpoints and recover records with user-defined models,
+// each model must embed Checkpoint or RecoverRecord respectively.
+// Built-in fields are filled before the mapping function is called, so the mapping function only needs to fill custom fields.
+// The checkpoint passed to mapCheckpoint can be asserted to flow.WorkFlow, flow.Process or flow.Step according to its scope.
+func NewSuspendPluginFor[C, R any, PC CheckpointModel[C], PR RecordModel[R]](db *gorm.DB,
+	mapCheckpoint func(cp flow.CheckPoint, model PC),
+	mapRecord func(record flow.RecoverRecord, model PR)) SuspendPlugin {
+	registerTypes()
+	s := &suspendPlugin[C, R, PC, PR]{
+		DB:            db,
+		mapCheckpoint: mapCheckpoint,
+		mapRecord:     mapRecord,
+		tenancy:       newTenancy(),
+		worker:        LocalWorker().String(),
+		continuous:    &continuous{},
+		recovery:      newRecovery(),
+		rejection:     &rejection{},
+		lease:         defaultLease,
+		renewals:      &sync.Map{},
+		expiry:        newExpiry(),
+		saveBatch:     defaultSaveBatch,
 	}
+	if s.mapCheckpoint == nil {
+		s.mapCheckpoint = func(flow.CheckPoint, PC) {}
+	}
+	if s.mapRecord == nil {
+		s.mapRecord = func(flow.RecoverRecord, PR) {}
+	}
+	return s
+}
+
+var registerOnce sync.Once
+
+// registerTypes registers the types that the plugin puts into contexts with the engine,
+// once a suspend plugin is created instead of on import.
+func registerTypes() {
+	registerOnce.Do(func() {
+		// payloads of signals decoded from JSON
+		flow.RegisterType[map[string]any]()
+		flow.RegisterType[[]any]()
+		// values journaled by continuous checkpointing, decoded by inspection as well as recovery
+		flow.RegisterType[map[string]map[string]any]()
+	})
 }
 
-func (s *suspendPlugin) GetLatestRecord(rootUid string) (flow.RecoverRecord, error) {
-	var record RecoverRecord
-	result := s.
+func (s *suspendPlugin[C, R, PC, PR]) GetLatestRecord(rootUid string) (flow.RecoverRecord, error) {
+	record := PR(new(R))
+	query, err := s.tenancy.scope(s.DB, s.tenantId, rootUid)
+	if err != nil {
+		return record, err
+	}
+	result := query.
 		Where("root_uid = ?", rootUid).
-		Where("status = ?", flow.RecoverIdle).
-		First(&record)
+		Where("status = ? OR (status = ? AND lease_expires_at < ?)", flow.RecoverIdle, flow.RecoverRunning, time.Now()).
+		Order("sequence DESC, created_at DESC").
+		First(record)
 	if result.Error != nil {
-		return &record, result.Error
+		return record, result.Error
 	}
-	return &record, nil
+	if s.heldByOther(record.recordModel()) {
+		return record, claimedBy(record.recordModel())
+	}
+	if record.GetStatus() == flow.RecoverIdle && s.expiry.expired(record.recordModel()) {
+		if _, err = s.expire(record); err != nil {
+			return record, err
+		}
+		return record, ErrRecordExpired
+	}
+	s.tenancy.alias(rootUid, record.GetRecoverId())
+	return record, nil
 }
 
-func (s *suspendPlugin) ListCheckpoints(recoverId string) ([]flow.CheckPoint, error) {
-	var checkpoints []*Checkpoint
-	result := s.
-		Where("recover_id = ?", recoverId).
-		Find(&checkpoints)
-	if result.Error != nil {
-		return nil, result.Error
+// ListCheckpoints returns a *CorruptionError if any checkpoint does not match its digest,
+// snapshots encrypted by retired keys are re-encrypted with the current key in memory.
+// A *DefinitionError is returned if the flow changed since suspension and no migration resolves it.
+func (s *suspendPlugin[C, R, PC, PR]) ListCheckpoints(recoverId string) ([]flow.CheckPoint, error) {
+	checkpoints, err := s.listCheckpoints(recoverId)
+	if err != nil {
+		return nil, err
 	}
 	cps := make([]flow.CheckPoint, len(checkpoints))
 	for i, cp := range checkpoints {
+		if err = s.open(cp.checkpointModel()); err != nil {
+			return nil, err
+		}
 		cps[i] = cp
 	}
+	if err = s.migrate(recoverId, checkpoints); err != nil {
+		return nil, err
+	}
 	return cps, nil
 }
 
-func (s *suspendPlugin) UpdateRecordStatus(record flow.RecoverRecord) error {
-	result := s.Model(&RecoverRecord{}).
-		Where("recover_id = ?", record.GetRecoverId()).
-		Update("status", record.GetStatus())
+// open turns the stored snapshot of cp into the snapshot that the engine loads with its current key.
+func (s *suspendPlugin[C, R, PC, PR]) open(cp *Checkpoint) error {
+	if corrupted := s.verify(cp); corrupted != nil {
+		return corrupted
+	}
+	if err := s.load(cp); err != nil {
+		return err
+	}
+	return s.rekey(cp)
+}
+
+// stored encodes the snapshot of engine for the row of checkpoint id in tx, and returns the columns to update.
+func (s *suspendPlugin[C, R, PC, PR]) stored(tx *gorm.DB, id string, snapshot []byte) (map[string]interface{}, error) {
+	cp := &Checkpoint{Id: id}
+	if err := s.store(cp, snapshot); err != nil {
+		return nil, err
+	}
+	if err := s.retain(tx, cp); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"snapshot":      cp.Snapshot,
+		"blob_key":      cp.BlobKey,
+		"snapshot_hash": cp.SnapshotHash,
+		"digest":        cp.Digest,
+		"key_id":        cp.KeyId,
+	}, nil
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) listCheckpoints(recoverId string) ([]PC, error) {
+	query, err := s.tenancy.scope(s.DB, s.tenantId, recoverId)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoints []PC
+	result := query.
+		Where("recover_id = ?", recoverId).
+		Find(&checkpoints)
 	if result.Error != nil {
-		return result.Error
+		return nil, result.Error
+	}
+	return checkpoints, nil
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) UpdateRecordStatus(record flow.RecoverRecord) error {
+	scope, err := s.tenancy.scoped(s.tenantId, record.GetRecoverId())
+	if err != nil {
+		return err
+	}
+	if record.GetStatus() == flow.RecoverRunning {
+		err := s.claim(scope, record.GetRecoverId(), true,
+			map[string]interface{}{"status": flow.RecoverRunning, "recovered_by": s.worker})
+		if err != nil {
+			return err
+		}
+		s.renew(record.GetRecoverId())
+		return nil
+	}
+	s.stopRenew(record.GetRecoverId())
+	changed, err := s.transit(record.GetRecoverId(), scope, map[string]interface{}{"status": record.GetStatus()})
+	if err != nil {
+		return err
+	}
+	if changed && record.GetStatus() == flow.RecoverSuccess {
+		// checkpoints are consumed, failing to collect them should not fail the recovery
+		if err = s.collect(record.GetRecoverId()); err != nil {
+			logger.Errorf("Collect checkpoints of RecoverRecord[RecoverId: %s] failed, error: %s", record.GetRecoverId(), err.Error())
+		}
 	}
 	return nil
 }
 
-func (s *suspendPlugin) SaveCheckpointAndRecord(checkpoints []flow.CheckPoint, record flow.RecoverRecord) error {
-	tx := s.Begin()
-	cps := make([]*Checkpoint, len(checkpoints))
+// SaveBatchSize inserts checkpoints size rows per statement, so that flows with thousands of steps
+// stay within the placeholder and packet limits of MySQL. All batches are saved in the same transaction.
+func (s *suspendPlugin[C, R, PC, PR]) SaveBatchSize(size int) SuspendPlugin {
+	if size > 0 {
+		s.saveBatch = size
+	}
+	return s
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) SaveCheckpointAndRecord(checkpoints []flow.CheckPoint, record flow.RecoverRecord) (err error) {
+	tenantId := ""
+	for _, cp := range checkpoints {
+		if ctx, ok := cp.(Context); ok && cp.GetScope() == flow.FlowScope {
+			tenantId = s.tenancy.resolve(ctx)
+		}
+	}
+	cps := make([]PC, len(checkpoints))
 	for i, cp := range checkpoints {
-		checkpoint := &Checkpoint{
-			Id:        cp.GetId(),
-			Uid:       cp.GetUid(),
-			Name:      cp.GetName(),
-			Snapshot:  cp.GetSnapshot(),
-			RecoverId: cp.GetRecoverId(),
-			ParentUid: cp.GetParentUid(),
-			RootUid:   cp.GetRootUid(),
-			Scope:     cp.GetScope(),
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
+		checkpoint, err := s.newCheckpoint(cp, tenantId)
+		if err != nil {
+			return err
 		}
 		cps[i] = checkpoint
 	}
-	if err := tx.Create(&cps).Error; err != nil {
-		tx.Rollback()
-		panic(err)
+	rcd := s.newRecord(record, tenantId)
+	rcd.recordModel().define(definitionOf(checkpoints))
+	waited, err := approvals(checkpoints, rcd.recordModel())
+	if err != nil {
+		return err
+	}
+	if len(waited) != 0 {
+		// suspended on purpose, it waits for Signal instead of recovery
+		rcd.recordModel().Status = RecoverWaiting
+	}
+	for attempt := 0; attempt < sequenceRetries; attempt++ {
+		err = s.Transaction(func(tx *gorm.DB) error {
+			if err := s.retain(tx, models(cps)...); err != nil {
+				return err
+			}
+			if err := tx.CreateInBatches(&cps, s.saveBatch).Error; err != nil {
+				return err
+			}
+			sequence, err := s.sequence(tx, rcd.GetRootUid())
+			if err != nil {
+				return err
+			}
+			rcd.recordModel().Sequence = sequence
+			if err := tx.Create(rcd).Error; err != nil {
+				if sequenceTaken(err) {
+					return errSequenceTaken
+				}
+				return err
+			}
+			if err := tx.Create(s.transition(rcd.recordModel(), 0, rcd.GetStatus())).Error; err != nil {
+				return err
+			}
+			if len(waited) != 0 {
+				return tx.Create(&waited).Error
+			}
+			return nil
+		})
+		if !errors.Is(err, errSequenceTaken) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) newCheckpoint(cp flow.CheckPoint, tenantId string) (PC, error) {
+	checkpoint := PC(new(C))
+	*checkpoint.checkpointModel() = Checkpoint{
+		Id:        cp.GetId(),
+		Uid:       cp.GetUid(),
+		Name:      cp.GetName(),
+		RecoverId: cp.GetRecoverId(),
+		ParentUid: cp.GetParentUid(),
+		RootUid:   cp.GetRootUid(),
+		Scope:     cp.GetScope(),
+		TenantId:  tenantId,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
 	}
-	rcd := &RecoverRecord{
+	if err := s.store(checkpoint.checkpointModel(), cp.GetSnapshot()); err != nil {
+		return nil, err
+	}
+	s.mapCheckpoint(cp, checkpoint)
+	return checkpoint, nil
+}
+
+func models[C any, PC CheckpointModel[C]](cps []PC) []*Checkpoint {
+	models := make([]*Checkpoint, len(cps))
+	for i, cp := range cps {
+		models[i] = cp.checkpointModel()
+	}
+	return models
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) newRecord(record flow.RecoverRecord, tenantId string) PR {
+	rcd := PR(new(R))
+	*rcd.recordModel() = RecoverRecord{
 		RootUid:   record.GetRootUid(),
 		RecoverId: record.GetRecoverId(),
 		Status:    record.GetStatus(),
 		Name:      record.GetName(),
+		TenantId:  tenantId,
+		CreatedBy: s.worker,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
-	if err := tx.Create(rcd).Error; err != nil {
-		tx.Rollback()
+	s.mapRecord(record, rcd)
+	return rcd
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) InjectSuspend() error {
+	flow.SuspendPersist(s)
+	if err := s.CreateTables(); err != nil {
 		return err
 	}
-	if err := tx.Commit().Error; err != nil {
-		tx.Rollback()
-		return err
+	defineOnce.Do(registerDefine)
+	if s.continuous.enable {
+		setJournaler(s)
+	} else {
+		setJournaler(nil)
 	}
+	s.autoRecover()
+	s.autoReject()
 	return nil
 }
 
-func (s *suspendPlugin) InjectSuspend() error {
-	flow.SuspendPersist(s)
-	return s.CreateTables()
-}
-
-func (s *suspendPlugin) CreateTables() error {
-	if tables, err := s.Migrator().GetTables(); err == nil && len(tables) >= 3 {
-		m := make(map[string]bool, len(tables))
-		for _, t := range tables {
-			m[t] = true
-		}
-		if m["recover_records"] && m["checkpoints"] {
-			return nil
-		}
+func (s *suspendPlugin[C, R, PC, PR]) CreateTables() error {
+	if err := s.renumber(); err != nil {
+		return err
 	}
-	if err := s.Migrator().CreateTable(&RecoverRecord{}); err != nil {
-		// can't use errors.Is(xxx, err), so use strings.Contains instead
-		if !strings.Contains(err.Error(), dbHasCreate) {
+	for _, model := range []interface{}{PR(new(R)), PC(new(C)), &RecoverRecordTransition{}, &CheckpointAudit{}, &SnapshotBlob{}, &Approval{}} {
+		if err := createOrMigrate(s.DB, model); err != nil {
 			return err
 		}
 	}
-	if err := s.Migrator().CreateTable(&Checkpoint{}); err != nil {
-		if !strings.Contains(err.Error(), dbHasCreate) {
-			return err
+	return nil
+}
+
+// WithTenant stamps the tenant resolved from flow context on every checkpoint and recover record,
+// reads must be scoped by Tenant(tenantId) afterwards.
+func (s *suspendPlugin[C, R, PC, PR]) WithTenant(resolver TenantResolver) SuspendPlugin {
+	s.tenancy.resolver = resolver
+	return s
+}
+
+// WithWorker records worker as the creator and recoverer of recover records instead of LocalWorker.
+func (s *suspendPlugin[C, R, PC, PR]) WithWorker(worker Worker) SuspendPlugin {
+	s.worker = worker.String()
+	return s
+}
+
+// Tenant returns a view whose reads only see the checkpoints and recover records of tenantId.
+func (s *suspendPlugin[C, R, PC, PR]) Tenant(tenantId string) SuspendPlugin {
+	return s.tenant(tenantId)
+}
+
+func (s *suspendPlugin[C, R, PC, PR]) tenant(tenantId string) *suspendPlugin[C, R, PC, PR] {
+	scoped := *s
+	scoped.tenantId = tenantId
+	return &scoped
+}
+
+// Recover re-executes the suspended flow, reads issued by the engine during recovery are scoped to the tenant of the view.
+func (s *suspendPlugin[C, R, PC, PR]) Recover(rootUid string) (flow.FinishedWorkFlow, error) {
+	if len(s.tenantId) != 0 {
+		if err := s.tenancy.bind(s.tenantId, rootUid); err != nil {
+			return nil, err
 		}
+		defer s.tenancy.unbind(rootUid)
 	}
-	return nil
+	return flow.RecoverFlow(rootUid)
+}
+
+func (c *Checkpoint) checkpointModel() *Checkpoint {
+	return c
+}
+
+func (r *RecoverRecord) recordModel() *RecoverRecord {
+	return r
+}
+
+func (r *RecoverRecord) define(definition string) {
+	r.Definition = definition
+	r.Fingerprint = fingerprint(definition)
 }
 
 func (c *Checkpoint) GetId() string {
@@ -0,0 +1,133 @@
+package orm
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"sync"
+)
+
+var (
+	ErrTenantRequired = errors.New("tenant isolation is enabled, use Tenant(tenantId) to scope reads")
+)
+
+// Context is implemented by flow.WorkFlow, flow.Process and flow.Step.
+type Context interface {
+	Get(key string) (value any, exist bool)
+}
+
+type TenantResolver func(ctx Context) string
+
+type tenancy struct {
+	sync.Mutex
+	resolver TenantResolver
+	bindings map[string]*binding
+}
+
+// binding scopes the reads issued by the engine during a tenant's recovery.
+type binding struct {
+	tenantId string
+	keys     []string
+	refs     int
+}
+
+func TenantFromKey(key string) TenantResolver {
+	return func(ctx Context) string {
+		if value, exist := ctx.Get(key); exist && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+}
+
+func newTenancy() *tenancy {
+	return &tenancy{bindings: make(map[string]*binding)}
+}
+
+func (t *tenancy) enabled() bool {
+	return t.resolver != nil
+}
+
+func (t *tenancy) resolve(ctx Context) string {
+	if t.resolver == nil || ctx == nil {
+		return ""
+	}
+	return t.resolver(ctx)
+}
+
+func (t *tenancy) bind(tenantId, key string) error {
+	t.Lock()
+	defer t.Unlock()
+	if b, exist := t.bindings[key]; exist {
+		if b.tenantId != tenantId {
+			return fmt.Errorf("%s is being recovered by another tenant", key)
+		}
+		b.refs++
+		return nil
+	}
+	t.bindings[key] = &binding{tenantId: tenantId, keys: []string{key}, refs: 1}
+	return nil
+}
+
+// alias makes the key share the binding of the bound key.
+func (t *tenancy) alias(bound, key string) {
+	t.Lock()
+	defer t.Unlock()
+	if b, exist := t.bindings[bound]; exist {
+		t.bindings[key] = b
+		b.keys = append(b.keys, key)
+	}
+}
+
+func (t *tenancy) unbind(key string) {
+	t.Lock()
+	defer t.Unlock()
+	b, exist := t.bindings[key]
+	if !exist {
+		return
+	}
+	if b.refs--; b.refs > 0 {
+		return
+	}
+	for _, k := range b.keys {
+		delete(t.bindings, k)
+	}
+}
+
+func (t *tenancy) bound(key string) (string, bool) {
+	t.Lock()
+	defer t.Unlock()
+	if b, exist := t.bindings[key]; exist {
+		return b.tenantId, true
+	}
+	return "", false
+}
+
+// scope restricts the query to tenantId, or to the tenant bound to key if tenantId is empty.
+func (t *tenancy) scope(db *gorm.DB, tenantId, key string) (*gorm.DB, error) {
+	scope, err := t.scoped(tenantId, key)
+	if err != nil {
+		return nil, err
+	}
+	return scope(db), nil
+}
+
+// scoped is scope in the form of gorm scopes, so that it can be applied within a transaction.
+func (t *tenancy) scoped(tenantId, key string) (func(db *gorm.DB) *gorm.DB, error) {
+	if len(tenantId) == 0 {
+		tenantId, _ = t.bound(key)
+	}
+	if len(tenantId) != 0 {
+		return func(db *gorm.DB) *gorm.DB {
+			return db.Where("tenant_id = ?", tenantId)
+		}, nil
+	}
+	if t.enabled() {
+		return nil, ErrTenantRequired
+	}
+	return unscoped, nil
+}
+
+func unscoped(db *gorm.DB) *gorm.DB {
+	return db
+}
@@ -0,0 +1,43 @@
+package orm
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"runtime/debug"
+)
+
+var (
+	localWorker = newLocalWorker()
+)
+
+// Worker identifies the instance executing flows.
+type Worker struct {
+	Host     string
+	Pid      int
+	Instance string
+	Version  string
+}
+
+// LocalWorker returns the identity of current process, its instance ID is generated once per process.
+func LocalWorker() Worker {
+	return localWorker
+}
+
+func newLocalWorker() Worker {
+	host, _ := os.Hostname()
+	worker := Worker{
+		Host:     host,
+		Pid:      os.Getpid(),
+		Instance: uuid.NewString(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		worker.Version = info.Main.Version
+	}
+	return worker
+}
+
+// String formats worker as host:pid/instance@version.
+func (w Worker) String() string {
+	return fmt.Sprintf("%s:%d/%s@%s", w.Host, w.Pid, w.Instance, w.Version)
+}
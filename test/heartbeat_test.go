@@ -0,0 +1,169 @@
+package test
+
+import (
+	plugins "github.com/Bilibotter/light-flow-plugins/orm"
+	"github.com/Bilibotter/light-flow/flow"
+	"github.com/google/uuid"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	persist := plugins.NewPersistPlugin(db0).Heartbeat(100 * time.Millisecond)
+	if err = persist.InjectPersistence(); err != nil {
+		t.Logf("Error injecting persistence: %v", err)
+		return
+	}
+	defer func() {
+		persist.Close()
+		if err = plugins.NewPersistPlugin(db0).InjectPersistence(); err != nil {
+			t.Errorf("Error restoring persistence: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestHeartbeat")
+	proc := wf.Process("TestHeartbeat")
+	proc.CustomStep(func(_ flow.Step) (any, error) {
+		time.Sleep(500 * time.Millisecond)
+		return "hello", nil
+	}, "1")
+	ff := flow.DoneFlow("TestHeartbeat", nil)
+	CheckFlowPersist(t, ff, 3)
+	var f plugins.Flow
+	if err = db.Where("id = ?", ff.ID()).First(&f).Error; err != nil {
+		t.Fatalf("Error getting Flow %s: %s", ff.Name(), err.Error())
+	}
+	if f.LastHeartbeat == nil || f.LastHeartbeat.Sub(*f.CreatedAt) < 200*time.Millisecond {
+		t.Errorf("Flow %s heartbeat not refreshed, last heartbeat: %v, created at: %v", ff.Name(), f.LastHeartbeat, f.CreatedAt)
+	}
+}
+
+func TestReapAbandoned(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	var hooked []string
+	persist := plugins.NewPersistPlugin(db0).OnAbandon(func(abandoned *plugins.Flow) error {
+		hooked = append(hooked, abandoned.Id)
+		return nil
+	})
+	if err = persist.InjectPersistence(); err != nil {
+		t.Logf("Error injecting persistence: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewPersistPlugin(db0).InjectPersistence(); err != nil {
+			t.Errorf("Error restoring persistence: %v", err)
+		}
+	}()
+	crashed := time.Now().Add(-time.Hour)
+	alive := time.Now()
+	orphan := &plugins.Flow{Id: uuid.NewString(), Name: "TestReapAbandoned", Status: plugins.Begin, LastHeartbeat: &crashed, CreatedAt: &crashed, UpdatedAt: &crashed}
+	running := &plugins.Flow{Id: uuid.NewString(), Name: "TestReapAbandoned", Status: plugins.Begin, LastHeartbeat: &alive, CreatedAt: &crashed, UpdatedAt: &alive}
+	proc := &plugins.Process{Id: uuid.NewString(), Name: "TestReapAbandoned", Status: plugins.Begin, FlowId: orphan.Id, CreatedAt: &crashed, UpdatedAt: &crashed}
+	step := &plugins.Step{Id: uuid.NewString(), Name: "1", Status: plugins.Begin, ProcId: proc.Id, FlowId: orphan.Id, CreatedAt: &crashed, UpdatedAt: &crashed}
+	for _, row := range []interface{}{orphan, running, proc, step} {
+		if err = db.Create(row).Error; err != nil {
+			t.Fatalf("Error creating row: %s", err.Error())
+		}
+	}
+	abandoned, err := persist.Reap(time.Minute)
+	if err != nil {
+		t.Fatalf("Error reaping flows: %s", err.Error())
+	}
+	find := false
+	for _, f := range abandoned {
+		if f.Id == running.Id {
+			t.Errorf("Flow %s with alive heartbeat should not be reaped", running.Id)
+		}
+		if f.Id == orphan.Id {
+			find = true
+		}
+	}
+	if !find {
+		t.Errorf("Flow %s with expired heartbeat should be reaped", orphan.Id)
+	}
+	find = false
+	for _, id := range hooked {
+		if id == orphan.Id {
+			find = true
+		}
+	}
+	if !find {
+		t.Errorf("OnAbandon hook should be called with Flow %s", orphan.Id)
+	}
+	var f plugins.Flow
+	if err = db.Where("id = ?", orphan.Id).First(&f).Error; err != nil || f.Status != plugins.Abandoned {
+		t.Errorf("Flow %s should be Abandoned but is %s", orphan.Id, stringStatus(f.Status))
+	}
+	var p plugins.Process
+	if err = db.Where("id = ?", proc.Id).First(&p).Error; err != nil || p.Status != plugins.Abandoned {
+		t.Errorf("Process %s should be Abandoned but is %s", proc.Id, stringStatus(p.Status))
+	}
+	var s plugins.Step
+	if err = db.Where("id = ?", step.Id).First(&s).Error; err != nil || s.Status != plugins.Abandoned {
+		t.Errorf("Step %s should be Abandoned but is %s", step.Id, stringStatus(s.Status))
+	}
+	if err = db.Where("id = ?", running.Id).First(&f).Error; err != nil || f.Status != plugins.Begin {
+		t.Errorf("Flow %s should be Begin but is %s", running.Id, stringStatus(f.Status))
+	}
+	if abandoned, err = persist.Reap(time.Minute); err != nil {
+		t.Fatalf("Error reaping flows: %s", err.Error())
+	}
+	for _, f := range abandoned {
+		if f.Id == orphan.Id {
+			t.Errorf("Flow %s should not be reaped twice", orphan.Id)
+		}
+	}
+}
+
+func TestReapCustomModel(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	var hooked []*AppFlow
+	persist := plugins.NewPersistPluginFor[AppFlow, AppProcess, AppStep](db0, nil, nil, nil).
+		OnAbandon(func(abandoned *AppFlow) error {
+			hooked = append(hooked, abandoned)
+			return nil
+		})
+	if err = persist.InjectPersistence(); err != nil {
+		t.Logf("Error injecting persistence: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewPersistPlugin(db0).InjectPersistence(); err != nil {
+			t.Errorf("Error restoring persistence: %v", err)
+		}
+	}()
+	crashed := time.Now().Add(-time.Hour)
+	orphan := &AppFlow{AppId: "app-1", Flow: plugins.Flow{Id: uuid.NewString(), Name: "TestReapCustomModel", Status: plugins.Begin, LastHeartbeat: &crashed, CreatedAt: &crashed, UpdatedAt: &crashed}}
+	if err = db.Create(orphan).Error; err != nil {
+		t.Fatalf("Error creating row: %s", err.Error())
+	}
+	abandoned, err := persist.Reap(time.Minute)
+	if err != nil {
+		t.Fatalf("Error reaping flows: %s", err.Error())
+	}
+	for _, reaped := range [][]*AppFlow{abandoned, hooked} {
+		find := false
+		for _, f := range reaped {
+			if f.Id == orphan.Id {
+				find = true
+				if f.AppId != "app-1" || f.Status != plugins.Abandoned {
+					t.Errorf("Flow %s has wrong AppId %s or status %s", orphan.Id, f.AppId, stringStatus(f.Status))
+				}
+			}
+		}
+		if !find {
+			t.Errorf("Flow %s with expired heartbeat should be reaped", orphan.Id)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package test
+
+import (
+	plugins "github.com/Bilibotter/light-flow-plugins/orm"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"testing"
+)
+
+func TestFlowLabels(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	plugin := plugins.NewPersistPlugin(db0).
+		LabelFromContext("tenant", "region").
+		LabelBy(func(_ flow.WorkFlow) map[string]string {
+			return map[string]string{"release": "v1.0.0"}
+		})
+	if err = plugin.InjectPersistence(); err != nil {
+		t.Logf("Error injecting persistence: %v", err)
+		return
+	}
+	wf := flow.RegisterFlow("TestFlowLabels")
+	proc := wf.Process("TestFlowLabels")
+	proc.CustomStep(func(_ flow.Step) (any, error) {
+		return "hello", nil
+	}, "1")
+	ff := flow.DoneFlow("TestFlowLabels", map[string]any{"tenant": "acme"})
+	CheckFlowPersist(t, ff, 3)
+	labels, err := plugin.ListLabels(ff.ID())
+	if err != nil {
+		t.Fatalf("Error listing labels: %s", err.Error())
+	}
+	if labels["tenant"] != "acme" {
+		t.Errorf("Label tenant should be acme but is %s", labels["tenant"])
+	}
+	if labels["release"] != "v1.0.0" {
+		t.Errorf("Label release should be v1.0.0 but is %s", labels["release"])
+	}
+	if _, exist := labels["region"]; exist {
+		t.Errorf("Label region should not exist")
+	}
+	flows, err := plugin.ListFlows("tenant=acme", "release=v1.0.0")
+	if err != nil {
+		t.Fatalf("Error listing flows: %s", err.Error())
+	}
+	find := false
+	for _, f := range flows {
+		if f.Id == ff.ID() {
+			find = true
+		}
+	}
+	if !find {
+		t.Errorf("Flow %s not found by label filter", ff.ID())
+	}
+	if flows, err = plugin.ListFlows("tenant=nobody"); err != nil {
+		t.Fatalf("Error listing flows: %s", err.Error())
+	}
+	for _, f := range flows {
+		if f.Id == ff.ID() {
+			t.Errorf("Flow %s should not match label filter tenant=nobody", ff.ID())
+		}
+	}
+	if _, err = plugin.ListFlows("tenant"); err == nil {
+		t.Errorf("Invalid label filter should return error")
+	}
+}
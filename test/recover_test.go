@@ -1,13 +1,23 @@
 package test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	plugins "github.com/Bilibotter/light-flow-plugins/orm"
 	"github.com/Bilibotter/light-flow/flow"
+	"github.com/google/uuid"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRecover(t *testing.T) {
@@ -63,3 +73,2067 @@ func TestRecover(t *testing.T) {
 		t.Errorf("TestRecover failed, count: %d, expected: 3", count)
 	}
 }
+
+type HostCheckpoint struct {
+	plugins.Checkpoint
+	Host      string `gorm:"column:host"`
+	FlowInput string `gorm:"column:flow_input"`
+}
+
+type HostRecord struct {
+	plugins.RecoverRecord
+	Host string `gorm:"column:host"`
+}
+
+func TestRecoverWithCustomModel(t *testing.T) {
+	suc := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	plugin := plugins.NewSuspendPluginFor[HostCheckpoint, HostRecord](db0,
+		func(cp flow.CheckPoint, model *HostCheckpoint) {
+			model.Host = "host-1"
+			if wf, ok := cp.(flow.WorkFlow); ok {
+				if input, exist := wf.Get("input"); exist {
+					model.FlowInput = input.(string)
+				}
+			}
+		},
+		func(_ flow.RecoverRecord, model *HostRecord) {
+			model.Host = "host-1"
+		})
+	if err = plugin.InjectSuspend(); err != nil {
+		t.Logf("Error injecting persistence: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend plugin: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestRecoverWithCustomModel")
+	wf.EnableRecover()
+	proc := wf.Process("TestRecoverWithCustomModel")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.CompareAndSwapInt64(&suc, 0, 1) {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	ff := flow.DoneFlow("TestRecoverWithCustomModel", map[string]any{"input": "hello"})
+	var record HostRecord
+	if err = db.Where("root_uid = ?", ff.ID()).First(&record).Error; err != nil {
+		t.Fatalf("Error getting recover record: %s", err.Error())
+	}
+	if record.Host != "host-1" {
+		t.Errorf("Recover record has wrong host: %s", record.Host)
+	}
+	var checkpoints []HostCheckpoint
+	if err = db.Where("recover_id = ?", record.RecoverId).Find(&checkpoints).Error; err != nil {
+		t.Fatalf("Error listing checkpoints: %s", err.Error())
+	}
+	for _, cp := range checkpoints {
+		if cp.Host != "host-1" {
+			t.Errorf("Checkpoint[%s] has wrong host: %s", cp.Name, cp.Host)
+		}
+		if cp.Scope == flow.FlowScope && cp.FlowInput != "hello" {
+			t.Errorf("Checkpoint[%s] has wrong flow input: %s", cp.Name, cp.FlowInput)
+		}
+	}
+	if ff, err = ff.Recover(); err != nil {
+		t.Errorf("Failed to recover flow: %s", err.Error())
+	} else if !ff.Success() {
+		t.Errorf("Flow should succeed, but failed")
+	}
+}
+
+func TestRecoverWorker(t *testing.T) {
+	suc := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	creator := plugins.Worker{Host: "pod-1", Pid: 1, Instance: "instance-1", Version: "v1.0.0"}
+	if err = plugins.NewSuspendPlugin(db0).WithWorker(creator).InjectSuspend(); err != nil {
+		t.Logf("Error injecting persistence: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend plugin: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestRecoverWorker")
+	wf.EnableRecover()
+	proc := wf.Process("TestRecoverWorker")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.CompareAndSwapInt64(&suc, 0, 1) {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	ff := flow.DoneFlow("TestRecoverWorker", nil)
+	if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+		t.Fatalf("Error injecting persistence: %v", err)
+	}
+	if ff, err = ff.Recover(); err != nil {
+		t.Fatalf("Failed to recover flow: %s", err.Error())
+	}
+	var record plugins.RecoverRecord
+	if err = db.Where("root_uid = ?", ff.ID()).First(&record).Error; err != nil {
+		t.Fatalf("Error getting recover record: %s", err.Error())
+	}
+	if record.CreatedBy != creator.String() {
+		t.Errorf("Recover record has wrong creator: %s, expected %s", record.CreatedBy, creator.String())
+	}
+	if record.RecoveredBy != plugins.LocalWorker().String() {
+		t.Errorf("Recover record has wrong recoverer: %s, expected %s", record.RecoveredBy, plugins.LocalWorker().String())
+	}
+}
+
+func TestContinuousCheckpoint(t *testing.T) {
+	count := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).ContinuousCheckpoint("order")
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend plugin: %v", err)
+		}
+	}()
+	crashed := int64(0)
+	wf := flow.RegisterFlow("TestContinuousCheckpoint")
+	wf.EnableRecover()
+	proc := wf.Process("TestContinuousCheckpoint")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&count, 1)
+		ctx.Set("order", "o-1")
+		return "r-1", nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&count, 1)
+		if atomic.CompareAndSwapInt64(&crashed, 0, 1) {
+			// stop journaling as if the process crashed while executing this step
+			if err := plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+				t.Errorf("Error simulating crash: %v", err)
+			}
+			return nil, nil
+		}
+		if order, exist := ctx.Get("order"); !exist || order != "o-1" {
+			t.Errorf("Step[%s] should see order carried over, got %v", ctx.Name(), order)
+		}
+		// step 1 is executed again since its result is read by step 2
+		if result, exist := ctx.Result("1"); !exist || result != "r-1" {
+			t.Errorf("Step[%s] should see result of step 1, got %v", ctx.Name(), result)
+		}
+		return nil, nil
+	}, "2", "1")
+	ff := flow.DoneFlow("TestContinuousCheckpoint", nil)
+	var record plugins.RecoverRecord
+	if err = db.Where("root_uid = ?", ff.ID()).First(&record).Error; err != nil {
+		t.Fatalf("Journal of interrupted flow should be kept: %s", err.Error())
+	}
+	if record.Status != plugins.RecoverJournal {
+		t.Errorf("Journal has wrong status: %d", record.Status)
+	}
+	var checkpoints []plugins.Checkpoint
+	db.Where("recover_id = ? AND scope = ?", record.RecoverId, flow.StepScope).Find(&checkpoints)
+	if len(checkpoints) != 2 {
+		t.Errorf("Step 1 should be kept in journal until step 2 completes, got %d steps", len(checkpoints))
+	}
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Fatalf("Error injecting suspend: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	resumed, err := suspend.ResumeInterrupted(time.Second)
+	if err != nil {
+		t.Errorf("Failed to resume interrupted flows: %s", err.Error())
+	}
+	found := false
+	for _, foo := range resumed {
+		if foo.ID() == ff.ID() {
+			found = true
+			if !foo.Success() {
+				t.Errorf("Resumed flow should succeed, but failed")
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Flow %s should be resumed", ff.ID())
+	}
+	if atomic.LoadInt64(&count) != 4 {
+		t.Errorf("TestContinuousCheckpoint failed, count: %d, expected: 4", count)
+	}
+	resumed, _ = suspend.ResumeInterrupted(time.Second)
+	for _, foo := range resumed {
+		if foo.ID() == ff.ID() {
+			t.Errorf("Flow %s should not be resumed twice", ff.ID())
+		}
+	}
+	// journal of finished flow is removed
+	ff = flow.DoneFlow("TestContinuousCheckpoint", nil)
+	var left int64
+	db.Model(&plugins.RecoverRecord{}).Where("root_uid = ?", ff.ID()).Count(&left)
+	if left != 0 {
+		t.Errorf("Journal of finished flow should be removed, %d left", left)
+	}
+}
+
+type journalOrder struct {
+	Id string
+}
+
+func TestContinuousCheckpointEncrypted(t *testing.T) {
+	flow.RegisterType[journalOrder]()
+	plugins.SetEncryptor(flow.NewAES256Encryptor([]byte("secret"), "token"))
+	defer plugins.DisableEncrypt()
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).ContinuousCheckpoint("order", "token")
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend plugin: %v", err)
+		}
+	}()
+	crashed, executed := int64(0), int64(0)
+	ready := make(chan struct{})
+	wf := flow.RegisterFlow("TestContinuousCheckpointEncrypted")
+	wf.EnableRecover()
+	proc := wf.Process("TestContinuousCheckpointEncrypted")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&executed, 1)
+		ctx.Set("order", journalOrder{Id: "o-1"})
+		ctx.Set("token", "t-1")
+		close(ready)
+		return nil, nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.CompareAndSwapInt64(&crashed, 0, 1) {
+			// wait until step 1 is committed
+			<-ready
+			time.Sleep(200 * time.Millisecond)
+			if err := plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+				t.Errorf("Error simulating crash: %v", err)
+			}
+			return nil, nil
+		}
+		// values set by step 1 are restored to the process, though step 1 is not executed again
+		if order, _ := ctx.Get("order"); order != (journalOrder{Id: "o-1"}) {
+			t.Errorf("Step[%s] should see order carried over, got %#v", ctx.Name(), order)
+		}
+		// the token is journaled encrypted and decrypted when it is restored
+		if token, _ := ctx.Get("token"); token != "t-1" {
+			t.Errorf("Step[%s] should see token decrypted, got %v", ctx.Name(), token)
+		}
+		return nil, nil
+	}, "2")
+	ff := flow.DoneFlow("TestContinuousCheckpointEncrypted", nil)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Fatalf("Error injecting suspend: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	resumed, err := suspend.ResumeInterrupted(time.Second)
+	if err != nil {
+		t.Errorf("Failed to resume interrupted flows: %s", err.Error())
+	}
+	found := false
+	for _, foo := range resumed {
+		if foo.ID() == ff.ID() {
+			found = true
+			if !foo.Success() {
+				t.Errorf("Resumed flow should succeed, but failed")
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Flow %s should be resumed", ff.ID())
+	}
+	if atomic.LoadInt64(&executed) != 1 {
+		t.Errorf("Committed step 1 should not be executed again, executed %d times", executed)
+	}
+}
+
+func TestContinuousCheckpointRecovered(t *testing.T) {
+	count := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).ContinuousCheckpoint("order")
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend plugin: %v", err)
+		}
+	}()
+	failed, crashed := int64(0), int64(0)
+	wf := flow.RegisterFlow("TestContinuousCheckpointRecovered")
+	wf.EnableRecover()
+	proc := wf.Process("TestContinuousCheckpointRecovered")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&count, 1)
+		ctx.Set("order", "o-1")
+		if atomic.CompareAndSwapInt64(&failed, 0, 1) {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&count, 1)
+		if atomic.CompareAndSwapInt64(&crashed, 0, 1) {
+			// stop journaling as if the process crashed while recovering
+			if err := plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+				t.Errorf("Error simulating crash: %v", err)
+			}
+			return nil, nil
+		}
+		if order, exist := ctx.Get("order"); !exist || order != "o-1" {
+			t.Errorf("Step[%s] should see order carried over, got %v", ctx.Name(), order)
+		}
+		return nil, nil
+	}, "2", "1")
+	ff := flow.DoneFlow("TestContinuousCheckpointRecovered", nil)
+	if ff.Success() {
+		t.Fatalf("Flow should fail before recovery")
+	}
+	if _, err = ff.Recover(); err != nil {
+		t.Fatalf("Failed to recover flow: %s", err.Error())
+	}
+	// the crashed recovery never finishes, its record is left running with an expired lease
+	db.Model(&plugins.RecoverRecord{}).
+		Where("root_uid = ? AND status <> ?", ff.ID(), plugins.RecoverJournal).
+		Updates(map[string]interface{}{"status": flow.RecoverRunning, "lease_expires_at": time.Now().Add(-time.Minute)})
+	var journal plugins.RecoverRecord
+	if err = db.Where("root_uid = ? AND status = ?", ff.ID(), plugins.RecoverJournal).First(&journal).Error; err != nil {
+		t.Fatalf("Recovered run should be journaled: %s", err.Error())
+	}
+	if journal.Sequence < 2 {
+		t.Errorf("Journal should follow the record it recovers, got sequence %d", journal.Sequence)
+	}
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Fatalf("Error injecting suspend: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	resumed, err := suspend.ResumeInterrupted(time.Second)
+	if err != nil {
+		t.Errorf("Failed to resume interrupted flows: %s", err.Error())
+	}
+	found := false
+	for _, foo := range resumed {
+		if foo.ID() == ff.ID() {
+			found = true
+			if !foo.Success() {
+				t.Errorf("Resumed flow should succeed, but failed")
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Flow %s should be resumed", ff.ID())
+	}
+	if atomic.LoadInt64(&count) != 5 {
+		t.Errorf("TestContinuousCheckpointRecovered failed, count: %d, expected: 5", count)
+	}
+	var origin plugins.RecoverRecord
+	db.Where("root_uid = ? AND sequence < ?", ff.ID(), journal.Sequence).Order("sequence DESC").First(&origin)
+	if origin.Status != flow.RecoverFailed {
+		t.Errorf("Interrupted recovery should be superseded by its journal, got status %d", origin.Status)
+	}
+}
+
+func TestAutoRecover(t *testing.T) {
+	fail := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).
+		WithTenant(plugins.TenantFromKey("tenant")).
+		MaxAttempts(2).
+		RecoverBackoff(0, 0).
+		RecoverConcurrency("TestAutoRecover", 1)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend plugin: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestAutoRecover")
+	wf.EnableRecover()
+	proc := wf.Process("TestAutoRecover")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if broken, _ := ctx.Get("broken"); broken == true {
+			atomic.AddInt64(&fail, 1)
+			return nil, errors.New("execute error")
+		}
+		if atomic.AddInt64(&fail, 1) == 1 {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	view := suspend.Tenant("auto-recover")
+	ff := flow.DoneFlow("TestAutoRecover", map[string]any{"tenant": "auto-recover"})
+	recovered, _ := view.RecoverOnce()
+	if len(recovered) != 1 || recovered[0].ID() != ff.ID() || !recovered[0].Success() {
+		t.Errorf("Flow %s should be recovered automatically", ff.ID())
+	}
+	if recovered, _ = view.RecoverOnce(); len(recovered) != 0 {
+		t.Errorf("Recovered flow should not be recovered again")
+	}
+
+	ff = flow.DoneFlow("TestAutoRecover", map[string]any{"tenant": "auto-recover", "broken": true})
+	for i := 0; i < 3; i++ {
+		_, _ = view.RecoverOnce()
+	}
+	var records []plugins.RecoverRecord
+	db.Where("root_uid = ?", ff.ID()).Order("created_at").Find(&records)
+	if len(records) != 3 {
+		t.Fatalf("Flow %s should leave 3 recover records, got %d", ff.ID(), len(records))
+	}
+	dead := 0
+	for _, record := range records {
+		if record.Status == plugins.RecoverDead {
+			dead++
+		} else if record.Status != flow.RecoverFailed {
+			t.Errorf("RecoverRecord %s has wrong status: %d", record.RecoverId, record.Status)
+		}
+	}
+	if dead != 1 {
+		t.Errorf("Exhausted record should be moved to dead letter")
+	}
+}
+
+func TestRecoverClaim(t *testing.T) {
+	suc := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	worker := plugins.Worker{Host: "other", Pid: 1, Instance: "TestRecoverClaim"}
+	other := plugins.NewSuspendPlugin(db0).WithWorker(worker)
+	wf := flow.RegisterFlow("TestRecoverClaim")
+	wf.EnableRecover()
+	proc := wf.Process("TestRecoverClaim")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.CompareAndSwapInt64(&suc, 0, 1) {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	ff := flow.DoneFlow("TestRecoverClaim", nil)
+	var record plugins.RecoverRecord
+	if err = db.Where("root_uid = ?", ff.ID()).First(&record).Error; err != nil {
+		t.Fatalf("Error getting recover record: %s", err.Error())
+	}
+	if err = other.Claim(record.RecoverId); err != nil {
+		t.Fatalf("Failed to claim recover record: %s", err.Error())
+	}
+	err = suspend.Claim(record.RecoverId)
+	if !errors.Is(err, plugins.ErrAlreadyClaimed) {
+		t.Errorf("Claim held by another worker should fail with ErrAlreadyClaimed, but got %v", err)
+	}
+	var claimed *plugins.ClaimedError
+	if !errors.As(err, &claimed) || claimed.Owner != worker.String() || !claimed.ExpiresAt.After(time.Now()) {
+		t.Errorf("Claim held by another worker should report its owner and lease, but got %#v", claimed)
+	}
+	if _, err = suspend.Recover(ff.ID()); !errors.Is(err, plugins.ErrAlreadyClaimed) {
+		t.Errorf("Recovery of claimed record should fail with ErrAlreadyClaimed, but got %v", err)
+	}
+	if _, err = ff.Recover(); !errors.Is(err, plugins.ErrAlreadyClaimed) {
+		t.Errorf("Recovery of claimed record should fail with ErrAlreadyClaimed, but got %v", err)
+	}
+	if err = other.Release(record.RecoverId); err != nil {
+		t.Fatalf("Failed to release recover record: %s", err.Error())
+	}
+	if ff, err = suspend.Recover(ff.ID()); err != nil {
+		t.Errorf("Failed to recover flow: %s", err.Error())
+	} else if !ff.Success() {
+		t.Errorf("Flow should succeed, but failed")
+	}
+	if err = db.Where("recover_id = ?", record.RecoverId).First(&record).Error; err != nil {
+		t.Fatalf("Error getting recover record: %s", err.Error())
+	}
+	if record.ClaimedBy != plugins.LocalWorker().String() || record.LeaseExpiresAt == nil {
+		t.Errorf("Recovered record should be claimed by current worker, got %s", record.ClaimedBy)
+	}
+}
+
+func TestRecoverLeaseRenew(t *testing.T) {
+	suc := int64(0)
+	slow := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	// a lease not greater than 0 keeps the default instead of panicking on renewal
+	if err = plugins.NewSuspendPlugin(db0).ClaimLease(0).InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	wf := flow.RegisterFlow("TestRecoverLeaseRenew")
+	wf.EnableRecover()
+	proc := wf.Process("TestRecoverLeaseRenew")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.CompareAndSwapInt64(&suc, 0, 1) {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.LoadInt64(&slow) == 0 {
+			return nil, nil
+		}
+		time.Sleep(time.Second)
+		var record plugins.RecoverRecord
+		if err := db.Where("root_uid = ? AND status = ?", ctx.FlowID(), flow.RecoverRunning).First(&record).Error; err != nil {
+			t.Errorf("Error getting running record: %s", err.Error())
+		} else if record.LeaseExpiresAt == nil || record.LeaseExpiresAt.Before(time.Now()) {
+			t.Errorf("Lease of a flow recovered by flow.RecoverFlow should be renewed")
+		}
+		return nil, nil
+	}, "2", "1")
+	ff := flow.DoneFlow("TestRecoverLeaseRenew", nil)
+	if ret, err := ff.Recover(); err != nil || !ret.Success() {
+		t.Errorf("Flow should be recovered with the default lease, err: %v", err)
+	}
+	if err = plugins.NewSuspendPlugin(db0).ClaimLease(300 * time.Millisecond).InjectSuspend(); err != nil {
+		t.Fatalf("Error injecting suspend: %v", err)
+	}
+	atomic.StoreInt64(&suc, 0)
+	atomic.StoreInt64(&slow, 1)
+	ff = flow.DoneFlow("TestRecoverLeaseRenew", nil)
+	if ret, err := flow.RecoverFlow(ff.ID()); err != nil || !ret.Success() {
+		t.Errorf("Flow should be recovered, err: %v", err)
+	}
+}
+
+func TestRecoverHistory(t *testing.T) {
+	count := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	wf := flow.RegisterFlow("TestRecoverHistory")
+	wf.EnableRecover()
+	proc := wf.Process("TestRecoverHistory")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.AddInt64(&count, 1) < 3 {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	ff := flow.DoneFlow("TestRecoverHistory", nil)
+	if _, err = suspend.Recover(ff.ID()); err == nil {
+		t.Errorf("First recovery should fail")
+	}
+	if ret, err := suspend.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Errorf("Second recovery should succeed, err: %v", err)
+	}
+	records, err := suspend.ListRecoverRecords(ff.ID())
+	if err != nil {
+		t.Fatalf("Error listing recover records: %s", err.Error())
+	}
+	if len(records) != 2 {
+		t.Fatalf("Flow %s should leave 2 recover records, got %d", ff.ID(), len(records))
+	}
+	if records[0].Sequence != 1 || records[0].Status != flow.RecoverFailed {
+		t.Errorf("First record should fail, got sequence %d status %d", records[0].Sequence, records[0].Status)
+	}
+	if records[1].Sequence != 2 || records[1].Status != flow.RecoverSuccess {
+		t.Errorf("Second record should succeed, got sequence %d status %d", records[1].Sequence, records[1].Status)
+	}
+	transitions, err := suspend.ListTransitions(ff.ID())
+	if err != nil {
+		t.Fatalf("Error listing transitions: %s", err.Error())
+	}
+	expected := [][2]uint8{
+		{0, flow.RecoverIdle}, {flow.RecoverIdle, flow.RecoverRunning}, {0, flow.RecoverIdle}, {flow.RecoverRunning, flow.RecoverFailed},
+		{flow.RecoverIdle, flow.RecoverRunning}, {flow.RecoverRunning, flow.RecoverSuccess},
+	}
+	if len(transitions) != len(expected) {
+		t.Fatalf("Flow %s should have %d transitions, got %d", ff.ID(), len(expected), len(transitions))
+	}
+	for i, transition := range transitions {
+		if transition.FromStatus != expected[i][0] || transition.ToStatus != expected[i][1] {
+			t.Errorf("Transition %d should be %d -> %d, got %d -> %d", i, expected[i][0], expected[i][1], transition.FromStatus, transition.ToStatus)
+		}
+		if transition.Actor != plugins.LocalWorker().String() {
+			t.Errorf("Transition %d has wrong actor: %s", i, transition.Actor)
+		}
+	}
+}
+
+func TestRecoverSequenceConcurrent(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	const n = 4
+	rootUid := uuid.NewString()
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			recoverId := uuid.NewString()
+			checkpoints := []flow.CheckPoint{&plugins.Checkpoint{
+				Id:        uuid.NewString(),
+				Uid:       rootUid,
+				Name:      "TestRecoverSequenceConcurrent",
+				RecoverId: recoverId,
+				RootUid:   rootUid,
+				Scope:     flow.FlowScope,
+			}}
+			errs <- suspend.SaveCheckpointAndRecord(checkpoints, &plugins.RecoverRecord{
+				RootUid: rootUid, RecoverId: recoverId, Status: flow.RecoverIdle, Name: "TestRecoverSequenceConcurrent"})
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err = <-errs; err != nil {
+			t.Errorf("Concurrent save should succeed, err: %v", err)
+		}
+	}
+	records, err := suspend.ListRecoverRecords(rootUid)
+	if err != nil {
+		t.Fatalf("Error listing recover records: %s", err.Error())
+	}
+	for i, record := range records {
+		if record.Sequence != uint(i+1) {
+			t.Errorf("Record %d should have sequence %d, got %d", i, i+1, record.Sequence)
+		}
+	}
+}
+
+func TestCheckpointGC(t *testing.T) {
+	count := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).CollectOnSuccess(plugins.DeleteCheckpoints)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	wf := flow.RegisterFlow("TestCheckpointGC")
+	wf.EnableRecover()
+	proc := wf.Process("TestCheckpointGC")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.AddInt64(&count, 1)%2 == 1 {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	checkpoints := func(rootUid string) int64 {
+		var n int64
+		db.Model(&plugins.Checkpoint{}).Where("root_uid = ?", rootUid).Count(&n)
+		return n
+	}
+	ff := flow.DoneFlow("TestCheckpointGC", nil)
+	if checkpoints(ff.ID()) == 0 {
+		t.Fatalf("Suspended flow %s should save checkpoints", ff.ID())
+	}
+	if _, err = suspend.Recover(ff.ID()); err != nil {
+		t.Fatalf("Failed to recover flow: %s", err.Error())
+	}
+	if n := checkpoints(ff.ID()); n != 0 {
+		t.Errorf("Checkpoints of recovered flow should be deleted, %d left", n)
+	}
+
+	suspend = plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Fatalf("Error injecting suspend: %v", err)
+	}
+	ff = flow.DoneFlow("TestCheckpointGC", nil)
+	if _, err = suspend.Recover(ff.ID()); err != nil {
+		t.Fatalf("Failed to recover flow: %s", err.Error())
+	}
+	if checkpoints(ff.ID()) == 0 {
+		t.Errorf("Checkpoints should be kept by default")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err = suspend.CollectGarbage(0, 1); err != nil {
+		t.Errorf("Failed to collect garbage: %s", err.Error())
+	}
+	if n := checkpoints(ff.ID()); n != 0 {
+		t.Errorf("Checkpoints of finished record should be collected, %d left", n)
+	}
+}
+
+func TestPurgeRecords(t *testing.T) {
+	count := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	wf := flow.RegisterFlow("TestPurgeRecords")
+	wf.EnableRecover()
+	proc := wf.Process("TestPurgeRecords")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.AddInt64(&count, 1)%2 == 1 {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	recovered := flow.DoneFlow("TestPurgeRecords", nil)
+	if _, err = suspend.Recover(recovered.ID()); err != nil {
+		t.Fatalf("Failed to recover flow: %s", err.Error())
+	}
+	suspended := flow.DoneFlow("TestPurgeRecords", nil)
+	records := func(rootUid string) int64 {
+		var n int64
+		db.Model(&plugins.RecoverRecord{}).Where("root_uid = ?", rootUid).Count(&n)
+		return n
+	}
+	if _, err = suspend.PurgeRecords(time.Hour, 1); err != nil {
+		t.Errorf("Failed to purge records: %s", err.Error())
+	}
+	if records(recovered.ID()) == 0 {
+		t.Errorf("Records finished within retention should be kept")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err = suspend.PurgeRecords(0, 1); err != nil {
+		t.Errorf("Failed to purge records: %s", err.Error())
+	}
+	if n := records(recovered.ID()); n != 0 {
+		t.Errorf("Records of recovered flow should be purged, %d left", n)
+	}
+	var left int64
+	db.Model(&plugins.Checkpoint{}).Where("root_uid = ?", recovered.ID()).Count(&left)
+	if left != 0 {
+		t.Errorf("Checkpoints of purged records should be deleted, %d left", left)
+	}
+	db.Model(&plugins.RecoverRecordTransition{}).Where("root_uid = ?", recovered.ID()).Count(&left)
+	if left != 0 {
+		t.Errorf("Transitions of purged records should be deleted, %d left", left)
+	}
+	if records(suspended.ID()) == 0 {
+		t.Errorf("Records of suspended flow should be kept")
+	}
+}
+
+func TestRecoverExpire(t *testing.T) {
+	expired := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).
+		ExpireAfter(time.Second, "TestRecoverExpire").
+		OnExpire(func(record *plugins.RecoverRecord) error {
+			if record.Name == "TestRecoverExpire" {
+				atomic.AddInt64(&expired, 1)
+			}
+			return nil
+		})
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	wf := flow.RegisterFlow("TestRecoverExpire")
+	wf.EnableRecover()
+	proc := wf.Process("TestRecoverExpire")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		return nil, errors.New("execute error")
+	}, "1")
+	ff := flow.DoneFlow("TestRecoverExpire", nil)
+	swept := flow.DoneFlow("TestRecoverExpire", nil)
+	time.Sleep(2100 * time.Millisecond)
+	if _, err = suspend.Recover(ff.ID()); !errors.Is(err, plugins.ErrRecordExpired) {
+		t.Errorf("Recovery of expired record should fail with ErrRecordExpired, but got %v", err)
+	}
+	if _, err = suspend.Recover(ff.ID()); err == nil {
+		t.Errorf("Expired record should not be recovered")
+	}
+	records, err := suspend.ExpireRecords()
+	if err != nil {
+		t.Errorf("Failed to expire records: %s", err.Error())
+	}
+	found := false
+	for _, record := range records {
+		found = found || record.RootUid == swept.ID()
+	}
+	if !found {
+		t.Errorf("Record of flow %s should be expired", swept.ID())
+	}
+	for _, rootUid := range []string{ff.ID(), swept.ID()} {
+		var record plugins.RecoverRecord
+		if err = db.Where("root_uid = ?", rootUid).First(&record).Error; err != nil {
+			t.Fatalf("Error getting recover record: %s", err.Error())
+		}
+		if record.Status != plugins.RecoverExpired {
+			t.Errorf("Record of flow %s should be expired, got status %d", rootUid, record.Status)
+		}
+	}
+	if atomic.LoadInt64(&expired) != 2 {
+		t.Errorf("OnExpire should be called twice, got %d", expired)
+	}
+}
+
+func TestRecoverExpireBeyondBatch(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).ExpireAfter(time.Hour, "TestRecoverExpireBeyondBatch")
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	// older idle records of a flow without ttl should not hide the ones that expire
+	records := make([]*plugins.RecoverRecord, 0, 102)
+	for i := 0; i < 101; i++ {
+		records = append(records, &plugins.RecoverRecord{RootUid: uuid.NewString(), RecoverId: uuid.NewString(),
+			Status: flow.RecoverIdle, Name: "TestRecoverExpireBeyondBatchKept", Sequence: 1, CreatedAt: time.Now().Add(-3 * time.Hour)})
+	}
+	target := &plugins.RecoverRecord{RootUid: uuid.NewString(), RecoverId: uuid.NewString(),
+		Status: flow.RecoverIdle, Name: "TestRecoverExpireBeyondBatch", Sequence: 1, CreatedAt: time.Now().Add(-2 * time.Hour)}
+	records = append(records, target)
+	if err = db.Create(&records).Error; err != nil {
+		t.Fatalf("Failed to create recover records: %s", err.Error())
+	}
+	expired, err := suspend.ExpireRecords()
+	if err != nil {
+		t.Fatalf("Failed to expire records: %s", err.Error())
+	}
+	if len(expired) != 1 || expired[0].RecoverId != target.RecoverId {
+		t.Errorf("Only the record of flow with ttl should be expired, got %d", len(expired))
+	}
+}
+
+func TestInspectCheckpoint(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	plugins.SetEncryptor(flow.NewAES256Encryptor([]byte("secret"), "password"))
+	defer plugins.DisableEncrypt()
+	wf := flow.RegisterFlow("TestInspectCheckpoint")
+	wf.EnableRecover()
+	proc := wf.Process("TestInspectCheckpoint")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		ctx.Set("password", "hidden")
+		return nil, errors.New("execute error")
+	}, "1")
+	ff := flow.DoneFlow("TestInspectCheckpoint", map[string]any{"order": "o-1"})
+	views, err := suspend.Inspect(ff.ID())
+	if err != nil {
+		t.Fatalf("Failed to inspect checkpoints: %s", err.Error())
+	}
+	values := make(map[string]any)
+	scopes := make(map[string]bool)
+	for _, view := range views {
+		scopes[view.Scope] = true
+		if len(view.Error) != 0 {
+			t.Errorf("Checkpoint %s failed to decode: %s", view.Name, view.Error)
+		}
+		for _, entry := range view.Entries {
+			if entry.Visibility != "internal" {
+				values[entry.Key] = entry.Value
+			}
+		}
+	}
+	if !scopes["flow"] || !scopes["process"] || !scopes["step"] {
+		t.Errorf("Checkpoints of every scope should be inspected, got %v", scopes)
+	}
+	if values["order"] != "o-1" {
+		t.Errorf("Flow context should be decoded, got %v", values["order"])
+	}
+	if values["password"] != "hidden" {
+		t.Errorf("Encrypted value should be decrypted, got %v", values["password"])
+	}
+	var buf bytes.Buffer
+	if err = plugins.WriteCheckpointsTable(&buf, views); err != nil || !strings.Contains(buf.String(), "o-1") {
+		t.Errorf("Table should contain context values, err: %v", err)
+	}
+	buf.Reset()
+	if err = plugins.WriteCheckpointsJSON(&buf, views); err != nil || !strings.Contains(buf.String(), "\"order\"") {
+		t.Errorf("JSON should contain context keys, err: %v", err)
+	}
+}
+
+func TestEditCheckpoint(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	wf := flow.RegisterFlow("TestEditCheckpoint")
+	wf.EnableRecover()
+	proc := wf.Process("TestEditCheckpoint")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if amount, _ := ctx.Get("amount"); amount.(int) < 0 {
+			return nil, errors.New("negative amount")
+		}
+		if _, exist := ctx.Get("debug"); exist {
+			return nil, errors.New("debug should be deleted")
+		}
+		return nil, nil
+	}, "1")
+	ff := flow.DoneFlow("TestEditCheckpoint", map[string]any{"amount": -1, "debug": true})
+	views, err := suspend.Inspect(ff.ID())
+	if err != nil {
+		t.Fatalf("Failed to inspect checkpoints: %s", err.Error())
+	}
+	checkpointId := ""
+	for _, view := range views {
+		if view.Scope == "flow" {
+			checkpointId = view.Id
+		}
+	}
+	if err = suspend.EditCheckpoint(checkpointId, "operator", "fix amount", plugins.OverrideKey("amount", 10), plugins.DeleteKey("debug")); err != nil {
+		t.Fatalf("Failed to edit checkpoint: %s", err.Error())
+	}
+	if ret, err := suspend.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Errorf("Flow should be recovered with the edited context, err: %v", err)
+	}
+	if err = suspend.EditCheckpoint(checkpointId, "operator", "too late", plugins.SetKey("amount", 1)); !errors.Is(err, plugins.ErrNotEditable) {
+		t.Errorf("Checkpoint of recovered record should not be editable, but got %v", err)
+	}
+	audits, err := suspend.ListAudits(ff.ID())
+	if err != nil {
+		t.Fatalf("Failed to list audits: %s", err.Error())
+	}
+	if len(audits) != 1 || audits[0].Version != 1 || audits[0].Operator != "operator" || len(audits[0].PreviousSnapshot) == 0 {
+		t.Errorf("Edit should be audited once, got %d audits", len(audits))
+	}
+	var cp plugins.Checkpoint
+	if err = db.Where("id = ?", checkpointId).First(&cp).Error; err != nil {
+		t.Fatalf("Error getting checkpoint: %s", err.Error())
+	}
+	if cp.Version != 1 {
+		t.Errorf("Checkpoint version should be 1, got %d", cp.Version)
+	}
+}
+
+func TestCheckpointIntegrity(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).SignWith([]byte("sign key"))
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestCheckpointIntegrity")
+	wf.EnableRecover()
+	proc := wf.Process("TestCheckpointIntegrity")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		return nil, errors.New("execute error")
+	}, "1")
+	ff := flow.DoneFlow("TestCheckpointIntegrity", map[string]any{"amount": 1})
+	var cp plugins.Checkpoint
+	if err = db.Where("root_uid = ? AND scope = ?", ff.ID(), flow.FlowScope).First(&cp).Error; err != nil {
+		t.Fatalf("Error getting checkpoint: %s", err.Error())
+	}
+	if len(cp.Digest) == 0 {
+		t.Errorf("Checkpoint should be saved with digest")
+	}
+	truncated := cp.Snapshot[:len(cp.Snapshot)/2]
+	if err = db.Model(&plugins.Checkpoint{}).Where("id = ?", cp.Id).Update("snapshot", truncated).Error; err != nil {
+		t.Fatalf("Error tampering checkpoint: %s", err.Error())
+	}
+	_, err = suspend.Recover(ff.ID())
+	var corrupted *plugins.CorruptionError
+	if !errors.As(err, &corrupted) || corrupted.CheckpointId != cp.Id || !errors.Is(err, plugins.ErrCheckpointCorrupted) {
+		t.Errorf("Recovery of tampered checkpoint should fail with CorruptionError, but got %v", err)
+	}
+	found := false
+	all, err := suspend.VerifyCheckpoints(10)
+	if err != nil {
+		t.Errorf("Failed to verify checkpoints: %s", err.Error())
+	}
+	for _, c := range all {
+		found = found || c.CheckpointId == cp.Id
+	}
+	if !found {
+		t.Errorf("Tampered checkpoint %s should be found by VerifyCheckpoints", cp.Id)
+	}
+	views, err := suspend.Inspect(ff.ID())
+	if err != nil {
+		t.Fatalf("Failed to inspect checkpoints: %s", err.Error())
+	}
+	for _, view := range views {
+		if view.Id == cp.Id && !strings.Contains(view.Error, cp.Id) {
+			t.Errorf("Inspected view should report corruption, got %q", view.Error)
+		}
+	}
+}
+
+func TestInspectCorrupted(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).SignWith([]byte("sign key")).DeduplicateSnapshots()
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestInspectCorrupted")
+	wf.EnableRecover()
+	proc := wf.Process("TestInspectCorrupted")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		return nil, errors.New("execute error")
+	}, "1")
+	ff := flow.DoneFlow("TestInspectCorrupted", map[string]any{"order": "o-1"})
+	var cp plugins.Checkpoint
+	if err = db.Where("root_uid = ? AND scope = ?", ff.ID(), flow.FlowScope).First(&cp).Error; err != nil {
+		t.Fatalf("Error getting checkpoint: %s", err.Error())
+	}
+	// the deduplicated snapshot is intact, only its digest no longer matches
+	if err = db.Model(&plugins.Checkpoint{}).Where("id = ?", cp.Id).Update("digest", "tampered").Error; err != nil {
+		t.Fatalf("Error tampering checkpoint: %s", err.Error())
+	}
+	views, err := suspend.Inspect(ff.ID())
+	if err != nil {
+		t.Fatalf("Failed to inspect checkpoints: %s", err.Error())
+	}
+	found := false
+	for _, view := range views {
+		if view.Id != cp.Id {
+			continue
+		}
+		found = true
+		if !strings.Contains(view.Error, cp.Id) {
+			t.Errorf("Inspected view should report corruption, got %q", view.Error)
+		}
+		decoded := false
+		for _, entry := range view.Entries {
+			decoded = decoded || (entry.Key == "order" && entry.Value == "o-1")
+		}
+		if !decoded {
+			t.Errorf("Corrupted checkpoint should still be decoded, got %v", view.Entries)
+		}
+	}
+	if !found {
+		t.Errorf("Checkpoint %s should be inspected", cp.Id)
+	}
+}
+
+func TestCheckpointUnsigned(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).SignWith([]byte("sign key"))
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend: %v", err)
+		}
+	}()
+	fail := int64(1)
+	wf := flow.RegisterFlow("TestCheckpointUnsigned")
+	wf.EnableRecover()
+	proc := wf.Process("TestCheckpointUnsigned")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.LoadInt64(&fail) == 1 {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	ff := flow.DoneFlow("TestCheckpointUnsigned", map[string]any{"amount": 1})
+	var cp plugins.Checkpoint
+	if err = db.Where("root_uid = ? AND scope = ?", ff.ID(), flow.FlowScope).First(&cp).Error; err != nil {
+		t.Fatalf("Error getting checkpoint: %s", err.Error())
+	}
+	// clearing the digest should not bypass the signature
+	if err = db.Model(&plugins.Checkpoint{}).Where("id = ?", cp.Id).Update("digest", "").Error; err != nil {
+		t.Fatalf("Error clearing digest: %s", err.Error())
+	}
+	_, err = suspend.Recover(ff.ID())
+	var corrupted *plugins.CorruptionError
+	if !errors.As(err, &corrupted) || corrupted.CheckpointId != cp.Id || !corrupted.Unsigned {
+		t.Errorf("Recovery of unsigned checkpoint should fail with CorruptionError, but got %v", err)
+	}
+	legacy := plugins.NewSuspendPlugin(db0).SignWith([]byte("sign key")).AllowUnsignedLegacy()
+	if err = legacy.InjectSuspend(); err != nil {
+		t.Fatalf("Error injecting suspend: %v", err)
+	}
+	found := false
+	all, err := legacy.VerifyCheckpoints(10)
+	if err != nil {
+		t.Errorf("Failed to verify checkpoints: %s", err.Error())
+	}
+	for _, c := range all {
+		found = found || (c.CheckpointId == cp.Id && c.Unsigned)
+	}
+	if !found {
+		t.Errorf("Unsigned checkpoint %s should be reported by VerifyCheckpoints", cp.Id)
+	}
+	atomic.StoreInt64(&fail, 0)
+	if ret, err := legacy.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Errorf("Unsigned legacy checkpoint should be recovered once allowed, err: %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	old := flow.NewAES256Encryptor([]byte("old secret"), "password")
+	plugins.SetKeyring(plugins.NewKeyring("v1", old))
+	defer plugins.DisableEncrypt()
+	executed := int64(0)
+	wf := flow.RegisterFlow("TestKeyRotation")
+	wf.EnableRecover()
+	proc := wf.Process("TestKeyRotation")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.AddInt64(&executed, 1) <= 2 {
+			return nil, errors.New("execute error")
+		}
+		if password, _ := ctx.Get("password"); password != "hidden" {
+			return nil, fmt.Errorf("password should be decrypted, got %v", password)
+		}
+		return nil, nil
+	}, "1")
+	recovered := flow.DoneFlow("TestKeyRotation", map[string]any{"password": "hidden"})
+	rotated := flow.DoneFlow("TestKeyRotation", map[string]any{"password": "hidden"})
+	plugins.SetKeyring(plugins.NewKeyring("v2", flow.NewAES256Encryptor([]byte("new secret"), "password")).Retired("v1", old))
+	if ret, err := suspend.Recover(recovered.ID()); err != nil || !ret.Success() {
+		t.Errorf("Checkpoint encrypted by retired key should be recovered, err: %v", err)
+	}
+	if _, err = suspend.RotateKeys(10); err != nil {
+		t.Errorf("Failed to rotate keys: %s", err.Error())
+	}
+	var count int64
+	db.Model(&plugins.Checkpoint{}).Where("root_uid = ? AND key_id <> ?", rotated.ID(), "v2").Count(&count)
+	if count != 0 {
+		t.Errorf("All checkpoints should be re-encrypted with v2, %d left", count)
+	}
+	plugins.SetKeyring(plugins.NewKeyring("v2", flow.NewAES256Encryptor([]byte("new secret"), "password")))
+	if ret, err := suspend.Recover(rotated.ID()); err != nil || !ret.Success() {
+		t.Errorf("Re-encrypted checkpoint should be recovered without retired key, err: %v", err)
+	}
+}
+
+func TestKeyRotationPlaintext(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	plugins.DisableEncrypt()
+	defer plugins.DisableEncrypt()
+	executed := int64(0)
+	wf := flow.RegisterFlow("TestKeyRotationPlaintext")
+	wf.EnableRecover()
+	proc := wf.Process("TestKeyRotationPlaintext")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.AddInt64(&executed, 1) <= 2 {
+			return nil, errors.New("execute error")
+		}
+		if password, _ := ctx.Get("password"); password != "hidden" {
+			return nil, fmt.Errorf("password should be decrypted, got %v", password)
+		}
+		return nil, nil
+	}, "1")
+	plain := flow.DoneFlow("TestKeyRotationPlaintext", map[string]any{"password": "hidden"})
+	legacy := flow.DoneFlow("TestKeyRotationPlaintext", map[string]any{"password": "hidden"})
+	var count int64
+	db.Model(&plugins.Checkpoint{}).Where("root_uid = ? AND key_id <> ?", plain.ID(), "-").Count(&count)
+	if count != 0 {
+		t.Errorf("Checkpoints saved without encryption should be marked plain, %d are not", count)
+	}
+	// checkpoints saved before key ids were recorded have the empty id
+	db.Model(&plugins.Checkpoint{}).Where("root_uid = ?", legacy.ID()).Update("key_id", "")
+	current := flow.NewAES256Encryptor([]byte("new secret"), "password")
+	plugins.SetKeyring(plugins.NewKeyring("v1", current))
+	if ret, err := suspend.Recover(plain.ID()); err != nil || !ret.Success() {
+		t.Errorf("Plain checkpoint should be encrypted before recovery, err: %v", err)
+	}
+	if _, err = suspend.Recover(legacy.ID()); !errors.Is(err, plugins.ErrUnknownKey) {
+		t.Errorf("Legacy checkpoint should fail with ErrUnknownKey until its key is retired, but got %v", err)
+	}
+	plugins.SetKeyring(plugins.NewKeyring("v1", current).Retired("", nil))
+	if ret, err := suspend.Recover(legacy.ID()); err != nil || !ret.Success() {
+		t.Errorf("Legacy plain checkpoint should be recovered once retired as nil, err: %v", err)
+	}
+}
+
+func TestSnapshotOffload(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	store, err := plugins.NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).OffloadAbove(32, store)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend: %v", err)
+		}
+	}()
+	flow.SetMaxSerializeSize(1 << 20)
+	defer flow.SetMaxSerializeSize(4096)
+	executed := int64(0)
+	large := strings.Repeat("large context ", 1000)
+	wf := flow.RegisterFlow("TestSnapshotOffload")
+	wf.EnableRecover()
+	proc := wf.Process("TestSnapshotOffload")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.AddInt64(&executed, 1) == 1 {
+			return nil, errors.New("execute error")
+		}
+		if value, _ := ctx.Get("large"); value != large {
+			return nil, errors.New("offloaded context should be restored")
+		}
+		return nil, nil
+	}, "1")
+	ff := flow.DoneFlow("TestSnapshotOffload", map[string]any{"large": large})
+	var cp plugins.Checkpoint
+	if err = db.Where("root_uid = ? AND scope = ?", ff.ID(), flow.FlowScope).First(&cp).Error; err != nil {
+		t.Fatalf("Error getting checkpoint: %s", err.Error())
+	}
+	if len(cp.BlobKey) == 0 {
+		t.Errorf("Large snapshot should be offloaded, got %d bytes in row", len(cp.Snapshot))
+	}
+	if ret, err := suspend.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Errorf("Flow should be recovered from offloaded snapshot, err: %v", err)
+	}
+}
+
+func TestSnapshotDeduplicate(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).DeduplicateSnapshots().CollectOnSuccess(plugins.DeleteCheckpoints)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend: %v", err)
+		}
+	}()
+	executed := int64(0)
+	wf := flow.RegisterFlow("TestSnapshotDeduplicate")
+	wf.EnableRecover()
+	proc := wf.Process("TestSnapshotDeduplicate")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.AddInt64(&executed, 1) == 1 {
+			return nil, errors.New("execute error")
+		}
+		if value, _ := ctx.Get("shared"); value != "value" {
+			return nil, errors.New("deduplicated context should be restored")
+		}
+		return nil, nil
+	}, "1")
+	ff := flow.DoneFlow("TestSnapshotDeduplicate", map[string]any{"shared": "value"})
+	var checkpoints []plugins.Checkpoint
+	if err = db.Where("root_uid = ? AND scope <> ?", ff.ID(), flow.StepScope).Find(&checkpoints).Error; err != nil {
+		t.Fatalf("Error getting checkpoints: %s", err.Error())
+	}
+	refs := make(map[string]int)
+	for _, cp := range checkpoints {
+		if len(cp.SnapshotHash) == 0 {
+			t.Errorf("Checkpoint %s should reference its snapshot by hash", cp.Name)
+		}
+		refs[cp.SnapshotHash]++
+	}
+	before := make(map[string]int)
+	for hash := range refs {
+		var blob plugins.SnapshotBlob
+		if err = db.Where("hash = ?", hash).First(&blob).Error; err != nil {
+			t.Fatalf("Snapshot blob %s should be saved: %s", hash, err.Error())
+		}
+		before[hash] = blob.RefCount
+	}
+	if ret, err := suspend.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Errorf("Flow should be recovered from deduplicated snapshots, err: %v", err)
+	}
+	for hash, count := range refs {
+		var blobs []plugins.SnapshotBlob
+		db.Where("hash = ?", hash).Find(&blobs)
+		left := 0
+		if len(blobs) != 0 {
+			left = blobs[0].RefCount
+		}
+		if left != before[hash]-count || (left == 0 && len(blobs) != 0) {
+			t.Errorf("Snapshot blob %s should be released, %d references left", hash, left)
+		}
+	}
+}
+
+func TestSnapshotDeduplicateCompact(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).DeduplicateSnapshots().CollectOnSuccess(plugins.CompactCheckpoints)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend: %v", err)
+		}
+	}()
+	executed := int64(0)
+	wf := flow.RegisterFlow("TestSnapshotDeduplicateCompact")
+	wf.EnableRecover()
+	proc := wf.Process("TestSnapshotDeduplicateCompact")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.AddInt64(&executed, 1) <= 2 {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	// both roots suspend with the same context, so their snapshots are likely to share blobs
+	compacted := flow.DoneFlow("TestSnapshotDeduplicateCompact", map[string]any{"shared": "value"})
+	kept := flow.DoneFlow("TestSnapshotDeduplicateCompact", map[string]any{"shared": "value"})
+	var checkpoints []plugins.Checkpoint
+	if err = db.Where("root_uid = ? AND snapshot_hash <> ''", compacted.ID()).Find(&checkpoints).Error; err != nil {
+		t.Fatalf("Error getting checkpoints: %s", err.Error())
+	}
+	if len(checkpoints) == 0 {
+		t.Fatalf("Checkpoints of %s should reference snapshots by hash", compacted.ID())
+	}
+	if ret, err := suspend.Recover(compacted.ID()); err != nil || !ret.Success() {
+		t.Fatalf("Flow should be recovered from deduplicated snapshots, err: %v", err)
+	}
+	var left int64
+	db.Model(&plugins.Checkpoint{}).Where("root_uid = ? AND snapshot_hash <> ''", compacted.ID()).Count(&left)
+	if left != 0 {
+		t.Errorf("Compacted checkpoints should not reference snapshots, %d left", left)
+	}
+	for _, cp := range checkpoints {
+		var refs int64
+		db.Model(&plugins.Checkpoint{}).Where("snapshot_hash = ?", cp.SnapshotHash).Count(&refs)
+		var blobs []plugins.SnapshotBlob
+		db.Where("hash = ?", cp.SnapshotHash).Find(&blobs)
+		if refs == 0 && len(blobs) != 0 {
+			t.Errorf("Snapshot blob %s should be deleted once unreferenced", cp.SnapshotHash)
+		}
+		if refs != 0 && (len(blobs) == 0 || int64(blobs[0].RefCount) != refs) {
+			t.Errorf("Snapshot blob %s should count %d references", cp.SnapshotHash, refs)
+		}
+	}
+	if ret, err := suspend.Recover(kept.ID()); err != nil || !ret.Success() {
+		t.Errorf("Flow sharing compacted snapshots should still be recovered, err: %v", err)
+	}
+}
+
+func largeCheckpoints(n int) ([]flow.CheckPoint, *plugins.RecoverRecord) {
+	rootUid, recoverId := uuid.NewString(), uuid.NewString()
+	checkpoints := make([]flow.CheckPoint, n)
+	for i := range checkpoints {
+		checkpoints[i] = &plugins.Checkpoint{
+			Id:        uuid.NewString(),
+			Uid:       uuid.NewString(),
+			Name:      fmt.Sprintf("step%d", i),
+			RecoverId: recoverId,
+			ParentUid: rootUid,
+			RootUid:   rootUid,
+			Scope:     flow.StepScope,
+		}
+	}
+	return checkpoints, &plugins.RecoverRecord{RootUid: rootUid, RecoverId: recoverId, Status: flow.RecoverIdle, Name: "TestSaveLargeCheckpoints"}
+}
+
+func TestSnapshotDeduplicateConcurrent(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).DeduplicateSnapshots()
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend: %v", err)
+		}
+	}()
+	shared := [][]byte{[]byte(uuid.NewString()), []byte(uuid.NewString()), []byte(uuid.NewString())}
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			checkpoints, record := largeCheckpoints(len(shared))
+			// the same snapshots are referenced in opposite orders
+			for j, cp := range checkpoints {
+				k := j
+				if i%2 == 1 {
+					k = len(shared) - 1 - j
+				}
+				cp.(*plugins.Checkpoint).Snapshot = shared[k]
+			}
+			errs <- suspend.SaveCheckpointAndRecord(checkpoints, record)
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err = <-errs; err != nil {
+			t.Errorf("Concurrent save should not deadlock, err: %v", err)
+		}
+	}
+}
+
+func TestSaveLargeCheckpoints(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).SaveBatchSize(1000)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	checkpoints, record := largeCheckpoints(10000)
+	if err = suspend.SaveCheckpointAndRecord(checkpoints, record); err != nil {
+		t.Fatalf("Failed to save checkpoints: %s", err.Error())
+	}
+	var count int64
+	db.Model(&plugins.Checkpoint{}).Where("recover_id = ?", record.RecoverId).Count(&count)
+	if count != 10000 {
+		t.Errorf("All checkpoints should be saved, got %d", count)
+	}
+	// saving the same checkpoints again violates primary key, it should fail without panic
+	if err = suspend.SaveCheckpointAndRecord(checkpoints, record); err == nil {
+		t.Errorf("Saving duplicate checkpoints should fail")
+	}
+	db.Model(&plugins.Checkpoint{}).Where("recover_id = ?", record.RecoverId).Count(&count)
+	if count != 10000 {
+		t.Errorf("Failed save should be rolled back, got %d checkpoints", count)
+	}
+}
+
+func BenchmarkSaveCheckpoints(b *testing.B) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		b.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		b.Skipf("Error injecting suspend: %v", err)
+	}
+	const n = 10000
+	elapsed := time.Duration(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		checkpoints, record := largeCheckpoints(n)
+		b.StartTimer()
+		start := time.Now()
+		if err = suspend.SaveCheckpointAndRecord(checkpoints, record); err != nil {
+			b.Fatalf("Failed to save checkpoints: %s", err.Error())
+		}
+		elapsed += time.Since(start)
+	}
+	b.ReportMetric(float64(n*b.N)/elapsed.Seconds(), "checkpoints/s")
+}
+
+func TestPlanRecovery(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	var fail int64 = 1
+	wf := flow.RegisterFlow("TestPlanRecovery")
+	wf.EnableRecover()
+	proc := wf.Process("TestPlanRecovery")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		ctx.Set("prepared", true)
+		return nil, nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.LoadInt64(&fail) == 1 {
+			return nil, errors.New("step 2 failed")
+		}
+		return nil, nil
+	}, "2", "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		return nil, nil
+	}, "3", "2")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		return nil, nil
+	}, "4")
+	ff := flow.DoneFlow("TestPlanRecovery", map[string]any{"amount": 1})
+	plan, err := suspend.PlanRecovery(ff.ID())
+	if err != nil {
+		t.Fatalf("Failed to plan recovery: %s", err.Error())
+	}
+	if !plan.Defined || plan.RerunAll || len(plan.Processes) != 1 {
+		t.Fatalf("Plan should cover the defined process only, got %+v", plan)
+	}
+	if strings.Join(plan.FlowKeys, ",") != "amount" {
+		t.Errorf("Flow key amount should be restored, got %v", plan.FlowKeys)
+	}
+	process := plan.Processes[0]
+	if !process.Recovering || process.RerunAll {
+		t.Errorf("Process should be recovering without re-running all steps")
+	}
+	if strings.Join(process.Rerun, ",") != "2,3" {
+		t.Errorf("Step 2 and its dependent step 3 should re-run, got %v", process.Rerun)
+	}
+	if strings.Join(process.Completed, ",") != "1,4" {
+		t.Errorf("Step 1 and 4 should be completed, got %v", process.Completed)
+	}
+	if text := plan.String(); !strings.Contains(text, "re-run:    2, 3") {
+		t.Errorf("Plan text should list the re-run steps, got:\n%s", text)
+	}
+	atomic.StoreInt64(&fail, 0)
+	if ret, err := suspend.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Errorf("Flow should be recovered as planned, err: %v", err)
+	}
+}
+
+func TestPlanRecoveryBeforeCallback(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	var fail int64 = 1
+	executed := int64(0)
+	wf := flow.RegisterFlow("TestPlanRecoveryBeforeCallback")
+	wf.EnableRecover()
+	proc := wf.Process("TestPlanRecoveryBeforeCallback")
+	proc.BeforeProcess(true, func(p flow.Process) (bool, error) {
+		if atomic.LoadInt64(&fail) == 1 {
+			return false, errors.New("before process failed")
+		}
+		return true, nil
+	})
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&executed, 1)
+		return nil, nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&executed, 1)
+		return nil, nil
+	}, "2", "1")
+	ff := flow.DoneFlow("TestPlanRecoveryBeforeCallback", nil)
+	plan, err := suspend.PlanRecovery(ff.ID())
+	if err != nil {
+		t.Fatalf("Failed to plan recovery: %s", err.Error())
+	}
+	if len(plan.Processes) != 1 || !plan.Processes[0].RerunAll {
+		t.Fatalf("Process whose before callback failed should re-run all steps, got %+v", plan)
+	}
+	if strings.Join(plan.Processes[0].Rerun, ",") != "1,2" || len(plan.Processes[0].Completed) != 0 {
+		t.Errorf("All steps should re-run, got re-run %v completed %v", plan.Processes[0].Rerun, plan.Processes[0].Completed)
+	}
+	atomic.StoreInt64(&fail, 0)
+	if ret, err := suspend.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Errorf("Flow should be recovered as planned, err: %v", err)
+	}
+	if atomic.LoadInt64(&executed) != 2 {
+		t.Errorf("Both steps should be executed by recovery, got %d", atomic.LoadInt64(&executed))
+	}
+}
+
+func TestRewindStep(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	var fail int64 = 1
+	var executed [4]int64
+	wf := flow.RegisterFlow("TestRewindStep")
+	wf.EnableRecover()
+	proc := wf.Process("TestRewindStep")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&executed[0], 1)
+		return nil, nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&executed[1], 1)
+		return nil, nil
+	}, "2", "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&executed[2], 1)
+		if atomic.LoadInt64(&fail) == 1 {
+			return nil, errors.New("step 3 failed")
+		}
+		return nil, nil
+	}, "3", "2")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&executed[3], 1)
+		return nil, nil
+	}, "4")
+	ff := flow.DoneFlow("TestRewindStep", nil)
+	atomic.StoreInt64(&fail, 0)
+	if ret, err := suspend.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Fatalf("Flow should be recovered, err: %v", err)
+	}
+	if err = suspend.RewindStep(ff.ID(), "TestRewindStep", "5", "operator", "unknown step"); !errors.Is(err, plugins.ErrNotRewindable) {
+		t.Errorf("Rewinding an unknown step should fail, but got %v", err)
+	}
+	if err = suspend.RewindStep(ff.ID(), "TestRewindStep", "2", "operator", "wrong output"); err != nil {
+		t.Fatalf("Failed to rewind step: %s", err.Error())
+	}
+	if ret, err := suspend.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Fatalf("Flow should be recovered from the rewound step, err: %v", err)
+	}
+	expected := [4]int64{1, 2, 3, 1}
+	for i := range executed {
+		if atomic.LoadInt64(&executed[i]) != expected[i] {
+			t.Errorf("Step %d should execute %d times, got %d", i+1, expected[i], atomic.LoadInt64(&executed[i]))
+		}
+	}
+	audits, err := suspend.ListAudits(ff.ID())
+	if err != nil {
+		t.Fatalf("Failed to list audits: %s", err.Error())
+	}
+	if len(audits) != 1 || !strings.Contains(audits[0].Changes, "rewind") {
+		t.Errorf("Rewind should be audited once, got %d audits", len(audits))
+	}
+}
+
+func TestForkRecovery(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	wf := flow.RegisterFlow("TestForkRecovery")
+	wf.EnableRecover()
+	proc := wf.Process("TestForkRecovery")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		ctx.Set("prepared", true)
+		return nil, nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if prepared, _ := ctx.Get("prepared"); prepared != true {
+			return nil, errors.New("context of process should be forked")
+		}
+		if amount, _ := ctx.Get("amount"); amount.(int) < 0 {
+			return nil, errors.New("negative amount")
+		}
+		return nil, nil
+	}, "2", "1")
+	ff := flow.DoneFlow("TestForkRecovery", map[string]any{"amount": -1})
+	records, err := suspend.ListRecoverRecords(ff.ID())
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Flow should be suspended once, err: %v", err)
+	}
+	origin := records[0].RecoverId
+	forkUid, err := suspend.ForkRecovery(origin, plugins.OverrideKey("amount", 10))
+	if err != nil {
+		t.Fatalf("Failed to fork recovery: %s", err.Error())
+	}
+	if ret, err := suspend.Recover(forkUid); err != nil || !ret.Success() {
+		t.Errorf("Fork should be recovered with the overridden context, err: %v", err)
+	}
+	forks, err := suspend.ListRecoverRecords(forkUid)
+	if err != nil || len(forks) != 1 {
+		t.Fatalf("Fork should have one record, err: %v", err)
+	}
+	if forks[0].ForkedFrom != origin || forks[0].Status != flow.RecoverSuccess {
+		t.Errorf("Fork should link to its origin and succeed, got %+v", forks[0])
+	}
+	records, err = suspend.ListRecoverRecords(ff.ID())
+	if err != nil || len(records) != 1 || records[0].Status != flow.RecoverIdle {
+		t.Errorf("Original record should stay idle, err: %v", err)
+	}
+	if ret, err := suspend.Recover(ff.ID()); err == nil && ret.Success() {
+		t.Errorf("Original record should keep its own context")
+	}
+}
+
+func TestRecoverBulk(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	var outage int64 = 1
+	wf := flow.RegisterFlow("TestRecoverBulk")
+	wf.EnableRecover()
+	proc := wf.Process("TestRecoverBulk")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		return nil, nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.LoadInt64(&outage) == 1 {
+			return nil, errors.New("downstream outage")
+		}
+		if fail, _ := ctx.Get("fail"); fail == true {
+			return nil, errors.New("fail again")
+		}
+		return nil, nil
+	}, "2", "1")
+	start := time.Now().Add(-time.Second)
+	roots := make([]string, 4)
+	for i := range roots {
+		roots[i] = flow.DoneFlow("TestRecoverBulk", map[string]any{"fail": i == 1}).ID()
+	}
+	atomic.StoreInt64(&outage, 0)
+	records, err := suspend.ListRecoverRecords(roots[2])
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Flow should be suspended once, err: %v", err)
+	}
+	other := plugins.NewSuspendPlugin(db0).WithWorker(plugins.Worker{Host: "other", Pid: 1, Instance: "TestRecoverBulk"})
+	if err = other.Claim(records[0].RecoverId); err != nil {
+		t.Fatalf("Failed to claim record: %s", err.Error())
+	}
+	var out bytes.Buffer
+	args := []string{"-name", "TestRecoverBulk", "-step", "2", "-after", start.Format(time.RFC3339), "-concurrency", "2", "-rate", "100"}
+	report, err := plugins.RecoverBulkCommand(suspend, args, &out)
+	if err != nil {
+		t.Fatalf("Failed to recover in bulk: %s", err.Error())
+	}
+	if report.Total != 4 || report.Succeeded != 2 || report.Failed != 1 || report.Skipped != 1 {
+		t.Errorf("Bulk recovery should succeed 2, fail 1 and skip 1, got %s", out.String())
+	}
+	for _, result := range report.Results {
+		if result.RootUid == roots[2] && result.Result != plugins.BulkSkipped {
+			t.Errorf("Record claimed by another worker should be skipped, got %s", result.Result)
+		}
+	}
+	if !strings.Contains(out.String(), `"result": "skipped"`) {
+		t.Errorf("Report should be written as JSON, got %s", out.String())
+	}
+}
+
+func TestDefinitionCheck(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	var fail int64 = 1
+	wf := flow.RegisterFlow("TestDefinitionCheck")
+	wf.EnableRecover()
+	proc := wf.Process("TestDefinitionCheck")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		return nil, nil
+	}, "1")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.LoadInt64(&fail) == 1 {
+			return nil, errors.New("step 2 failed")
+		}
+		return nil, nil
+	}, "2", "1")
+	ff := flow.DoneFlow("TestDefinitionCheck", nil)
+	atomic.StoreInt64(&fail, 0)
+	records, err := suspend.ListRecoverRecords(ff.ID())
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Flow should be suspended once, err: %v", err)
+	}
+	// pretend step 2 was named legacy when the flow was suspended
+	legacy := strings.Replace(records[0].Definition, `"name":"2"`, `"name":"legacy"`, 1)
+	sum := sha256.Sum256([]byte(legacy))
+	err = db.Model(&plugins.RecoverRecord{}).
+		Where("recover_id = ?", records[0].RecoverId).
+		Updates(map[string]any{"definition": legacy, "fingerprint": hex.EncodeToString(sum[:])}).Error
+	if err != nil {
+		t.Fatalf("Error updating record: %s", err.Error())
+	}
+	if err = db.Model(&plugins.Checkpoint{}).Where("root_uid = ? AND name = ?", ff.ID(), "2").Update("name", "legacy").Error; err != nil {
+		t.Fatalf("Error updating checkpoint: %s", err.Error())
+	}
+	if err = suspend.CheckDefinitions(wf).InjectSuspend(); err != nil {
+		t.Fatalf("Error injecting suspend: %v", err)
+	}
+	_, err = suspend.Recover(ff.ID())
+	var mismatch *plugins.DefinitionError
+	if !errors.As(err, &mismatch) || !strings.Contains(err.Error(), "removed steps: TestDefinitionCheck/legacy") {
+		t.Fatalf("Recovery should be refused with the diff, but got %v", err)
+	}
+	suspend.MigrateWith(func(diff *plugins.DefinitionDiff) ([]plugins.StepRename, error) {
+		return []plugins.StepRename{{Process: "TestDefinitionCheck", From: "legacy", To: "2"}}, nil
+	})
+	if ret, err := suspend.Recover(ff.ID()); err != nil || !ret.Success() {
+		t.Errorf("Flow should be recovered after migration, err: %v", err)
+	}
+}
+
+func TestSignalApproval(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0)
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	var executed int64
+	wf := flow.RegisterFlow("TestSignalApproval")
+	wf.EnableRecover()
+	proc := wf.Process("TestSignalApproval")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		timeout, _ := ctx.Get("timeout")
+		payload, err := plugins.WaitForSignal(ctx, "approval", timeout.(time.Duration))
+		if err != nil {
+			return nil, err
+		}
+		if payload.(map[string]any)["approved"] != true {
+			return nil, errors.New("not approved")
+		}
+		return nil, nil
+	}, "approve")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		atomic.AddInt64(&executed, 1)
+		return nil, nil
+	}, "ship", "approve")
+	ff := flow.DoneFlow("TestSignalApproval", map[string]any{"timeout": time.Duration(0)})
+	records, err := suspend.ListRecoverRecords(ff.ID())
+	if err != nil || len(records) != 1 || records[0].Status != plugins.RecoverWaiting {
+		t.Fatalf("Flow should be waiting for signal, err: %v", err)
+	}
+	recoverId := records[0].RecoverId
+	pending, err := suspend.PendingApprovals()
+	if err != nil {
+		t.Fatalf("Failed to list pending approvals: %s", err.Error())
+	}
+	found := false
+	for _, approval := range pending {
+		found = found || (approval.RecoverId == recoverId && approval.Step == "approve" && approval.Signal == "approval")
+	}
+	if !found {
+		t.Errorf("Approval of %s should be pending", recoverId)
+	}
+	// the wait is saved with the process checkpoint rather than kept by this instance
+	views, err := suspend.Inspect(recoverId)
+	if err != nil {
+		t.Fatalf("Failed to inspect checkpoints: %s", err.Error())
+	}
+	saved := false
+	for _, view := range views {
+		for _, entry := range view.Entries {
+			saved = saved || (view.Scope == "process" && entry.Key == "~wait~approve")
+		}
+	}
+	if !saved {
+		t.Errorf("Signal waited for should be saved with the process checkpoint")
+	}
+	if ret, err := suspend.RecoverOnce(); err != nil || len(ret) != 0 && ret[0].ID() == ff.ID() {
+		t.Errorf("Waiting record should not be recovered automatically, err: %v", err)
+	}
+	server := httptest.NewServer(plugins.SignalHandler(suspend, func(r *http.Request) (string, error) {
+		switch operator := r.Header.Get("X-Operator"); operator {
+		case "":
+			return "", errors.New("unauthenticated")
+		case "mallory":
+			return "", plugins.ErrForbidden
+		default:
+			return operator, nil
+		}
+	}))
+	defer server.Close()
+	body := fmt.Sprintf(`{"recover_id": %q, "payload": {"approved": true}}`, recoverId)
+	post := func(operator string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if len(operator) != 0 {
+			req.Header.Set("X-Operator", operator)
+		}
+		return http.DefaultClient.Do(req)
+	}
+	for operator, status := range map[string]int{"": http.StatusUnauthorized, "mallory": http.StatusForbidden} {
+		resp, err := post(operator)
+		if err != nil {
+			t.Fatalf("Failed to signal: %s", err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("Signal of operator %q should be answered with %d, got %d", operator, status, resp.StatusCode)
+		}
+	}
+	resp, err := post("alice")
+	if err != nil {
+		t.Fatalf("Failed to signal: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusAccepted || !strings.Contains(string(reply), `"result":"signaled"`) {
+		t.Errorf("Signal should be accepted, got %d %s", resp.StatusCode, reply)
+	}
+	for i := 0; i < 50 && atomic.LoadInt64(&executed) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if atomic.LoadInt64(&executed) != 1 {
+		t.Errorf("Step after approval should execute once, got %d", atomic.LoadInt64(&executed))
+	}
+	decided := plugins.Approval{}
+	if err = db0.Where("recover_id = ?", recoverId).First(&decided).Error; err != nil || decided.DecidedBy != "alice" {
+		t.Errorf("Approval should be decided by the operator, got %q, err: %v", decided.DecidedBy, err)
+	}
+	if _, err = suspend.Signal(recoverId, "alice", nil); !errors.Is(err, plugins.ErrNotWaiting) {
+		t.Errorf("Signaled record should not be signaled again, but got %v", err)
+	}
+
+	ff = flow.DoneFlow("TestSignalApproval", map[string]any{"timeout": time.Millisecond})
+	records, err = suspend.ListRecoverRecords(ff.ID())
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Flow should be suspended once, err: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	rejected, err := suspend.RejectTimedOut()
+	if err != nil {
+		t.Fatalf("Failed to reject timed out approvals: %s", err.Error())
+	}
+	if !strings.Contains(strings.Join(rejected, ","), records[0].RecoverId) {
+		t.Errorf("Timed out approval should be rejected, got %v", rejected)
+	}
+	records, err = suspend.ListRecoverRecords(ff.ID())
+	if err != nil || records[0].Status != flow.RecoverFailed {
+		t.Errorf("Rejected record should fail, err: %v", err)
+	}
+	timedOut := plugins.Approval{}
+	if err = db0.Where("recover_id = ?", records[0].RecoverId).First(&timedOut).Error; err != nil || timedOut.DecidedBy != plugins.LocalWorker().String() {
+		t.Errorf("Timed out approval should be decided by the worker, got %q, err: %v", timedOut.DecidedBy, err)
+	}
+}
+
+func TestSignalApprovalTenant(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	suspend := plugins.NewSuspendPlugin(db0).WithTenant(plugins.TenantFromKey("tenant"))
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend plugin: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestSignalApprovalTenant")
+	wf.EnableRecover()
+	proc := wf.Process("TestSignalApprovalTenant")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		return plugins.WaitForSignal(ctx, "approval", time.Millisecond)
+	}, "approve")
+	ff := flow.DoneFlow("TestSignalApprovalTenant", map[string]any{"tenant": "signal-tenant"})
+	view := suspend.Tenant("signal-tenant")
+	records, err := view.ListRecoverRecords(ff.ID())
+	if err != nil || len(records) != 1 || records[0].Status != plugins.RecoverWaiting {
+		t.Fatalf("Flow should be waiting for signal, err: %v", err)
+	}
+	if _, err = suspend.PendingApprovals(); !errors.Is(err, plugins.ErrTenantRequired) {
+		t.Errorf("Pending approvals should be scoped by tenant, but got %v", err)
+	}
+	if pending, err := suspend.Tenant("another-tenant").PendingApprovals(); err != nil || len(pending) != 0 {
+		t.Errorf("Approvals of other tenants should not be listed, got %d, err: %v", len(pending), err)
+	}
+	if pending, err := view.PendingApprovals(); err != nil || len(pending) != 1 || pending[0].TenantId != "signal-tenant" {
+		t.Errorf("Approval of the tenant should be listed, err: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	rejected, err := suspend.RejectTimedOut()
+	if err != nil {
+		t.Fatalf("Failed to reject timed out approvals: %s", err.Error())
+	}
+	if !strings.Contains(strings.Join(rejected, ","), records[0].RecoverId) {
+		t.Errorf("Timed out approval should be rejected within its tenant, got %v", rejected)
+	}
+	records, err = view.ListRecoverRecords(ff.ID())
+	if err != nil || records[0].Status != flow.RecoverFailed {
+		t.Errorf("Rejected record should fail, err: %v", err)
+	}
+}
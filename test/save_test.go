@@ -27,6 +27,8 @@ func stringStatus(status int8) string {
 		return "Success"
 	case plugins.Failure:
 		return "Failure"
+	case plugins.Abandoned:
+		return "Abandoned"
 	default:
 		return "Unknown"
 	}
@@ -245,3 +247,144 @@ func TestFailureStepPersist(t *testing.T) {
 	ff := flow.DoneFlow("TestFailureStepPersist", nil)
 	CheckFlowPersist(t, ff, 3)
 }
+
+type AppFlow struct {
+	plugins.Flow
+	AppId string
+}
+
+type AppProcess struct {
+	plugins.Process
+	AppId string
+}
+
+type AppStep struct {
+	plugins.Step
+	AppId string
+}
+
+func (AppFlow) TableName() string {
+	return "app_flows"
+}
+
+func (AppProcess) TableName() string {
+	return "app_processes"
+}
+
+func (AppStep) TableName() string {
+	return "app_steps"
+}
+
+func TestCustomModelPersist(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	appId := func(ctx interface {
+		Get(key string) (any, bool)
+	}) string {
+		if value, exist := ctx.Get("appId"); exist {
+			return value.(string)
+		}
+		return ""
+	}
+	plugin := plugins.NewPersistPluginFor[AppFlow, AppProcess, AppStep](db0,
+		func(wf flow.WorkFlow, record *AppFlow) { record.AppId = appId(wf) },
+		func(proc flow.Process, record *AppProcess) { record.AppId = appId(proc) },
+		func(step flow.Step, record *AppStep) { record.AppId = appId(step) })
+	if err = plugin.InjectPersistence(); err != nil {
+		t.Logf("Error injecting persistence: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewPersistPlugin(db0).InjectPersistence(); err != nil {
+			t.Errorf("Error restoring persistence: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestCustomModelPersist")
+	proc := wf.Process("TestCustomModelPersist")
+	proc.CustomStep(func(_ flow.Step) (any, error) {
+		return "hello", nil
+	}, "1")
+	ff := flow.DoneFlow("TestCustomModelPersist", map[string]any{"appId": "app-1"})
+	var f AppFlow
+	if err = db.Where("id = ?", ff.ID()).First(&f).Error; err != nil {
+		t.Fatalf("Error getting Flow %s: %s", ff.Name(), err.Error())
+	}
+	if f.AppId != "app-1" {
+		t.Errorf("Flow %s has wrong AppId: %s", ff.Name(), f.AppId)
+	}
+	if f.Status != plugins.Success {
+		t.Errorf("Flow %s should be Success but is %s", ff.Name(), stringStatus(f.Status))
+	}
+	for _, p := range ff.Processes() {
+		var record AppProcess
+		if err = db.Where("id = ?", p.ID()).First(&record).Error; err != nil {
+			t.Errorf("Error getting Process %s: %s", p.Name(), err.Error())
+		} else if record.AppId != "app-1" {
+			t.Errorf("Process %s has wrong AppId: %s", p.Name(), record.AppId)
+		}
+		for _, step := range p.Steps() {
+			var s AppStep
+			if err = db.Where("id = ?", step.ID()).First(&s).Error; err != nil {
+				t.Errorf("Error getting Step %s: %s", step.Name(), err.Error())
+			} else if s.AppId != "app-1" || s.Status != plugins.Success {
+				t.Errorf("Step %s has wrong AppId %s or status %s", step.Name(), s.AppId, stringStatus(s.Status))
+			}
+		}
+	}
+	flows, err := plugin.ListFlows()
+	if err != nil {
+		t.Fatalf("Error listing flows: %s", err.Error())
+	}
+	var listed bool
+	for _, foo := range flows {
+		if foo.Id == ff.ID() {
+			listed = true
+			if foo.AppId != "app-1" {
+				t.Errorf("Listed Flow %s has wrong AppId: %s", ff.Name(), foo.AppId)
+			}
+		}
+	}
+	if !listed {
+		t.Errorf("Flow %s should be listed", ff.Name())
+	}
+}
+
+func TestWorkerPersist(t *testing.T) {
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	worker := plugins.Worker{Host: "pod-1", Pid: 1, Instance: "instance-1", Version: "v1.0.0"}
+	if err = plugins.NewPersistPlugin(db0).WithWorker(worker).InjectPersistence(); err != nil {
+		t.Logf("Error injecting persistence: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewPersistPlugin(db0).InjectPersistence(); err != nil {
+			t.Errorf("Error restoring persistence: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestWorkerPersist")
+	proc := wf.Process("TestWorkerPersist")
+	proc.CustomStep(func(_ flow.Step) (any, error) {
+		return "hello", nil
+	}, "1")
+	ff := flow.DoneFlow("TestWorkerPersist", nil)
+	CheckFlowPersist(t, ff, 3)
+	var f plugins.Flow
+	if err = db.Where("id = ?", ff.ID()).First(&f).Error; err != nil {
+		t.Fatalf("Error getting Flow %s: %s", ff.Name(), err.Error())
+	}
+	if f.Worker != worker.String() {
+		t.Errorf("Flow %s has wrong worker: %s, expected %s", ff.Name(), f.Worker, worker.String())
+	}
+	var s plugins.Step
+	if err = db.Where("flow_id = ?", ff.ID()).First(&s).Error; err != nil {
+		t.Fatalf("Error getting Step of %s: %s", ff.Name(), err.Error())
+	}
+	if s.Worker != worker.String() {
+		t.Errorf("Step %s has wrong worker: %s, expected %s", s.Name, s.Worker, worker.String())
+	}
+}
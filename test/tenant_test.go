@@ -0,0 +1,100 @@
+package test
+
+import (
+	"errors"
+	plugins "github.com/Bilibotter/light-flow-plugins/orm"
+	"github.com/Bilibotter/light-flow/flow"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	suc := int64(0)
+	db0, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failureed to open database: %v", err)
+	}
+	persist := plugins.NewPersistPlugin(db0).WithTenant(plugins.TenantFromKey("tenant"))
+	if err = persist.InjectPersistence(); err != nil {
+		t.Logf("Error injecting persistence: %v", err)
+		return
+	}
+	suspend := plugins.NewSuspendPlugin(db0).WithTenant(plugins.TenantFromKey("tenant"))
+	if err = suspend.InjectSuspend(); err != nil {
+		t.Logf("Error injecting suspend: %v", err)
+		return
+	}
+	defer func() {
+		if err = plugins.NewPersistPlugin(db0).InjectPersistence(); err != nil {
+			t.Errorf("Error restoring persistence: %v", err)
+		}
+		if err = plugins.NewSuspendPlugin(db0).InjectSuspend(); err != nil {
+			t.Errorf("Error restoring suspend plugin: %v", err)
+		}
+	}()
+	wf := flow.RegisterFlow("TestTenantIsolation")
+	wf.EnableRecover()
+	proc := wf.Process("TestTenantIsolation")
+	proc.CustomStep(func(ctx flow.Step) (any, error) {
+		if atomic.CompareAndSwapInt64(&suc, 0, 1) {
+			return nil, errors.New("execute error")
+		}
+		return nil, nil
+	}, "1")
+	ff := flow.DoneFlow("TestTenantIsolation", map[string]any{"tenant": "acme"})
+	var f plugins.Flow
+	if err = db.Where("id = ?", ff.ID()).First(&f).Error; err != nil {
+		t.Fatalf("Error getting Flow %s: %s", ff.Name(), err.Error())
+	}
+	if f.TenantId != "acme" {
+		t.Errorf("Flow %s has wrong tenant: %s", ff.Name(), f.TenantId)
+	}
+	var step plugins.Step
+	if err = db.Where("flow_id = ?", ff.ID()).First(&step).Error; err != nil {
+		t.Fatalf("Error getting Step of %s: %s", ff.Name(), err.Error())
+	}
+	if step.TenantId != "acme" {
+		t.Errorf("Step %s has wrong tenant: %s", step.Name, step.TenantId)
+	}
+	if _, err = persist.ListFlows(); !errors.Is(err, plugins.ErrTenantRequired) {
+		t.Errorf("Unscoped ListFlows should fail with ErrTenantRequired, but got %v", err)
+	}
+	if flows, err := persist.Tenant("other").ListFlows(); err != nil {
+		t.Errorf("Error listing flows: %s", err.Error())
+	} else {
+		for _, foo := range flows {
+			if foo.Id == ff.ID() {
+				t.Errorf("Flow %s should not be visible to another tenant", ff.ID())
+			}
+		}
+	}
+	if flows, err := persist.Tenant("acme").ListFlows(); err != nil || len(flows) == 0 {
+		t.Errorf("Flows of tenant acme should be listed, err: %v", err)
+	}
+	var record plugins.RecoverRecord
+	if err = db.Where("root_uid = ?", ff.ID()).First(&record).Error; err != nil {
+		t.Fatalf("Error getting recover record: %s", err.Error())
+	}
+	if record.TenantId != "acme" {
+		t.Errorf("Recover record has wrong tenant: %s", record.TenantId)
+	}
+	if _, err = suspend.ListCheckpoints(record.RecoverId); !errors.Is(err, plugins.ErrTenantRequired) {
+		t.Errorf("Unscoped ListCheckpoints should fail with ErrTenantRequired, but got %v", err)
+	}
+	if cps, err := suspend.Tenant("other").ListCheckpoints(record.RecoverId); err != nil || len(cps) != 0 {
+		t.Errorf("Checkpoints should not be visible to another tenant, err: %v", err)
+	}
+	if _, err = ff.Recover(); err == nil {
+		t.Errorf("Unscoped recovery should fail")
+	}
+	if _, err = suspend.Tenant("other").Recover(ff.ID()); err == nil {
+		t.Errorf("Recovery by another tenant should fail")
+	}
+	if ff, err = suspend.Tenant("acme").Recover(ff.ID()); err != nil {
+		t.Errorf("Failed to recover flow: %s", err.Error())
+	} else if !ff.Success() {
+		t.Errorf("Flow should succeed, but failed")
+	}
+}